@@ -617,3 +617,41 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 	structMapMutex.Unlock()
 	return sinfo, nil
 }
+
+// StructField describes how a struct field is marshalled. Index is the
+// field's index sequence for reflect.Type.FieldByIndex, longer than one
+// for fields of inlined structs.
+type StructField struct {
+	Key       string
+	Index     []int
+	OmitEmpty bool
+	MinSize   bool
+}
+
+// StructFields returns the fields of the struct type t in the order Marshal
+// writes them, with inlined structs flattened and "-" fields left out.
+func StructFields(t reflect.Type) (fields []StructField, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if s, ok := r.(externalPanic); ok {
+				err = errors.New(string(s))
+			} else if s, ok := r.(string); ok {
+				err = errors.New(s)
+			} else {
+				panic(r)
+			}
+		}
+	}()
+	sinfo, err := getStructInfo(t)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range sinfo.FieldsList {
+		index := info.Inline
+		if index == nil {
+			index = []int{info.Num}
+		}
+		fields = append(fields, StructField{info.Key, index, info.OmitEmpty, info.MinSize})
+	}
+	return fields, nil
+}
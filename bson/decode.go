@@ -631,6 +631,9 @@ func (d *decoder) readBinary() Binary {
 	b.Data = d.readBytes(l)
 	if b.Kind == 0x02 {
 		// Weird obsolete format with redundant length.
+		if len(b.Data) < 4 {
+			corrupted()
+		}
 		b.Data = b.Data[4:]
 	}
 	return b
@@ -702,6 +705,9 @@ func (d *decoder) readByte() byte {
 }
 
 func (d *decoder) readBytes(length int32) []byte {
+	if length < 0 {
+		corrupted()
+	}
 	start := d.i
 	d.i += int(length)
 	if d.i > len(d.in) {
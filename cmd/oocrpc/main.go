@@ -0,0 +1,375 @@
+// Date: 2026-10-17
+// oocrpc calls methods on a running server, args are given as json and
+// replies are printed as json
+//
+//	oocrpc [flags] addr Service.Method '{"a": 7, "b": 8}'
+//	oocrpc [flags] addr
+//
+// Without a method it reads "Service.Method {json}" lines until EOF.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"oocrpc/bson"
+	"oocrpc/rpc"
+)
+
+var (
+	network     = flag.String("network", "tcp", "tcp or unix")
+	timeout     = flag.Duration("timeout", rpc.DefaultTimeout, "give up on a call after this")
+	repeat      = flag.Int("repeat", 1, "make the call this many times and print timings")
+	concurrency = flag.Int("concurrency", 1, "calls in flight at once with -repeat")
+	compact     = flag.Bool("compact", false, "print replies on a single line")
+	useTLS      = flag.Bool("tls", false, "connect with TLS")
+	caFile      = flag.String("cacert", "", "verify the server with the CA certificates in this PEM file")
+	certFile    = flag.String("cert", "", "present the client certificate in this PEM file")
+	keyFile     = flag.String("key", "", "the key of -cert")
+	insecure    = flag.Bool("insecure", false, "don't verify the server certificate")
+	token       = flag.String("token", "", "authenticate with this token")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: oocrpc [flags] addr [Service.Method [json]]")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 || flag.NArg() > 3 {
+		usage()
+		os.Exit(2)
+	}
+
+	opts := []rpc.DialOption{rpc.WithNetwork(*network),
+		rpc.WithDialTimeout(*timeout), rpc.WithPoolSize(*concurrency)}
+	if *useTLS || *caFile != "" || *certFile != "" {
+		config, err := tlsConfig()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "oocrpc:", err)
+			os.Exit(2)
+		}
+		opts = append(opts, rpc.WithTLSConfig(config))
+	}
+	if *token != "" {
+		opts = append(opts, rpc.WithCredentials(rpc.TokenCredentials(*token)))
+	}
+	client, err := rpc.Dial(flag.Arg(0), opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "oocrpc:", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+	client.Timeout = *timeout
+
+	if flag.NArg() == 1 {
+		interactive(client)
+		return
+	}
+	args, err := parseArgs(flag.Arg(2))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "oocrpc:", err)
+		os.Exit(2)
+	}
+	if *repeat > 1 {
+		if !bench(client, flag.Arg(1), args, *repeat, *concurrency) {
+			os.Exit(1)
+		}
+		return
+	}
+	if err := call(client, flag.Arg(1), args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "oocrpc:", err)
+		os.Exit(1)
+	}
+}
+
+func tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: *insecure}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + *caFile)
+		}
+	}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// decode a json document into bson, integers become int64 and other
+// numbers float64. An empty string is an empty document.
+func parseArgs(s string) (bson.M, error) {
+	if strings.TrimSpace(s) == "" {
+		return bson.M{}, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("bad json args: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("bad json args: trailing data")
+	}
+	doc, ok := toBSON(v).(bson.M)
+	if !ok {
+		return nil, errors.New("bad json args: not an object")
+	}
+	return doc, nil
+}
+
+func toBSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		doc := make(bson.M, len(v))
+		for k, e := range v {
+			doc[k] = toBSON(e)
+		}
+		return doc
+	case []interface{}:
+		for i, e := range v {
+			v[i] = toBSON(e)
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// make the call and print the reply
+func call(client *rpc.Client, method string, args bson.M, w io.Writer) error {
+	reply := bson.M{}
+	if err := client.Call(method, args, &reply); err != nil {
+		return err
+	}
+	var out []byte
+	var err error
+	if *compact {
+		out, err = json.Marshal(reply)
+	} else {
+		out, err = json.MarshalIndent(reply, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(out))
+	return nil
+}
+
+// make the call n times, c at once, and print the timings. False if any
+// call failed.
+func bench(client *rpc.Client, method string, args bson.M, n, c int) bool {
+	if c < 1 {
+		c = 1
+	}
+	var mu sync.Mutex
+	var latencies []time.Duration
+	errs := make(map[string]int)
+	next := make(chan struct{})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < c; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range next {
+				t := time.Now()
+				err := client.Call(method, args, &bson.M{})
+				d := time.Since(t)
+				mu.Lock()
+				latencies = append(latencies, d)
+				if err != nil {
+					errs[err.Error()]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- struct{}{}
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, d := range latencies {
+		total += d
+	}
+	failed := 0
+	for _, count := range errs {
+		failed += count
+	}
+	fmt.Printf("%d calls, %d failed, %.1f calls/s\n", n, failed, float64(n)/elapsed.Seconds())
+	fmt.Printf("min %v  avg %v  p50 %v  p99 %v  max %v\n", latencies[0], total/time.Duration(n),
+		percentile(latencies, 50), percentile(latencies, 99), latencies[n-1])
+	for msg, count := range errs {
+		fmt.Printf("%6d  %s\n", count, msg)
+	}
+	return failed == 0
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+const interactiveHelp = `Service.Method {json}   make a call, the args default to {}
+list                    the services of the server
+describe [Service]      the methods and their types
+history                 the previous lines
+!!  !n                  run the last line again, or line n
+quit                    or EOF
+`
+
+// read calls from stdin, the lines are kept in ~/.oocrpc_history
+func interactive(client *rpc.Client) {
+	history := loadHistory()
+	hf := openHistory()
+	if hf != nil {
+		defer hf.Close()
+	}
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for {
+		fmt.Print("oocrpc> ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		line := strings.TrimSpace(in.Text())
+		if strings.HasPrefix(line, "!") {
+			var ok bool
+			if line, ok = recall(history, line); !ok {
+				fmt.Println("no such history line")
+				continue
+			}
+			fmt.Println(line)
+		}
+		switch {
+		case line == "":
+			continue
+		case line == "quit" || line == "exit":
+			return
+		case line == "help":
+			fmt.Print(interactiveHelp)
+			continue
+		case line == "history":
+			for i, h := range history {
+				fmt.Printf("%5d  %s\n", i+1, h)
+			}
+			continue
+		}
+
+		history = append(history, line)
+		if hf != nil {
+			fmt.Fprintln(hf, line)
+		}
+		method, rest := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			method, rest = line[:i], line[i+1:]
+		}
+		switch method {
+		case "list":
+			method, rest = "_rpc.ListServices", ""
+		case "describe":
+			method, rest = "_rpc.Describe", `{"service": `+strconv.Quote(strings.TrimSpace(rest))+`}`
+		}
+		args, err := parseArgs(rest)
+		if err == nil {
+			err = call(client, method, args, os.Stdout)
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+		}
+	}
+}
+
+// the line a "!!" or "!n" refers to
+func recall(history []string, line string) (string, bool) {
+	if line == "!!" {
+		if len(history) == 0 {
+			return "", false
+		}
+		return history[len(history)-1], true
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > len(history) {
+		return "", false
+	}
+	return history[n-1], true
+}
+
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".oocrpc_history")
+}
+
+// the last 500 lines of the history file
+func loadHistory() []string {
+	path := historyPath()
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(string(bytes.TrimSpace(data)), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	if len(lines) > 500 {
+		lines = lines[len(lines)-500:]
+	}
+	return lines
+}
+
+func openHistory() *os.File {
+	path := historyPath()
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil
+	}
+	return f
+}
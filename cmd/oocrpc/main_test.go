@@ -0,0 +1,132 @@
+// Date: 2026-10-17
+// tests of the argument parsing, history and timing math of oocrpc
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"oocrpc/bson"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want bson.M
+		err  string
+	}{
+		{"", bson.M{}, ""},
+		{"  \n", bson.M{}, ""},
+		{"{}", bson.M{}, ""},
+		{`{"a": 7, "b": 8}`, bson.M{"a": int64(7), "b": int64(8)}, ""},
+		{`{"x": 1.5, "big": 9007199254740993}`, bson.M{"x": 1.5, "big": int64(9007199254740993)}, ""},
+		{`{"s": "hi", "ok": true, "none": null}`, bson.M{"s": "hi", "ok": true, "none": nil}, ""},
+		{`{"in": {"n": 1}, "list": [1, 2.5, {"m": 3}]}`,
+			bson.M{"in": bson.M{"n": int64(1)}, "list": []interface{}{int64(1), 2.5, bson.M{"m": int64(3)}}}, ""},
+		{`{"a": 1`, nil, "bad json args"},
+		{`{"a": 1} {"b": 2}`, nil, "trailing data"},
+		{`[1, 2]`, nil, "not an object"},
+		{`7`, nil, "not an object"},
+	} {
+		got, err := parseArgs(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseArgs(%q): expected an error with %q, got %v", tt.in, tt.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseArgs(%q) = %#v, %v, want %#v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestToBSON(t *testing.T) {
+	for _, tt := range []struct {
+		in   interface{}
+		want interface{}
+	}{
+		{json.Number("42"), int64(42)},
+		{json.Number("-3"), int64(-3)},
+		{json.Number("0.25"), 0.25},
+		{json.Number("1e3"), 1000.0},
+		{"text", "text"},
+		{nil, nil},
+		{[]interface{}{json.Number("1")}, []interface{}{int64(1)}},
+		{map[string]interface{}{"a": []interface{}{map[string]interface{}{}}}, bson.M{"a": []interface{}{bson.M{}}}},
+	} {
+		if got := toBSON(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("toBSON(%#v) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+	// and it survives the round trip to bson
+	doc, _ := parseArgs(`{"a": 7, "f": 0.5, "l": [1]}`)
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back bson.M
+	if err = bson.Unmarshal(data, &back); err != nil || back["a"] != int64(7) || back["f"] != 0.5 {
+		t.Errorf("round trip: got %#v, %v", back, err)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	ms := func(ns ...int) []time.Duration {
+		var ds []time.Duration
+		for _, n := range ns {
+			ds = append(ds, time.Duration(n)*time.Millisecond)
+		}
+		return ds
+	}
+	hundred := make([]int, 100)
+	for i := range hundred {
+		hundred[i] = i + 1
+	}
+	for _, tt := range []struct {
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{ms(5), 50, 5 * time.Millisecond},
+		{ms(5), 99, 5 * time.Millisecond},
+		{ms(1, 2), 50, 1 * time.Millisecond},
+		{ms(1, 2), 99, 2 * time.Millisecond},
+		{ms(1, 2, 3), 50, 2 * time.Millisecond},
+		{ms(1, 2, 3, 4), 50, 2 * time.Millisecond},
+		{ms(hundred...), 50, 50 * time.Millisecond},
+		{ms(hundred...), 99, 99 * time.Millisecond},
+		{ms(hundred...), 100, 100 * time.Millisecond},
+		{ms(hundred...), 0, 1 * time.Millisecond},
+	} {
+		if got := percentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("percentile of %d values, p%d = %v, want %v", len(tt.sorted), tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestRecall(t *testing.T) {
+	history := []string{"list", "Arith.Add {}", "describe Arith"}
+	for _, tt := range []struct {
+		history []string
+		line    string
+		want    string
+		ok      bool
+	}{
+		{history, "!!", "describe Arith", true},
+		{history, "!1", "list", true},
+		{history, "!3", "describe Arith", true},
+		{history, "!0", "", false},
+		{history, "!4", "", false},
+		{history, "!x", "", false},
+		{nil, "!!", "", false},
+	} {
+		if got, ok := recall(tt.history, tt.line); got != tt.want || ok != tt.ok {
+			t.Errorf("recall(%q) = %q, %v, want %q, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
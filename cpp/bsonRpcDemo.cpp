@@ -57,7 +57,8 @@ bool WriteRpcRequestArgs(tcp::socket& socket,  BSONObj& arg )
 }
 
 
-int ReadRpcResponseHeader(tcp::socket& socket) 
+// errCode receives the code of a BackendError, if any
+int ReadRpcResponseHeader(tcp::socket& socket, std::string* errCode = NULL) 
 {
 	boost::system::error_code ec;
 	unsigned int responseLen;
@@ -82,6 +83,8 @@ int ReadRpcResponseHeader(tcp::socket& socket)
 		if (o.getField("error").str().size() > 0)	//error found!!
 		{
 			//cout << o.jsonString(JS, 1) << endl;
+			if (errCode != NULL && o.hasField("code"))
+				*errCode = o.getField("code").str();
 			free(leftData);
 			return 0;
 		}
@@ -119,7 +122,7 @@ bool ReadRpcResponseBody(tcp::socket& socket, BSONObj* result)
 	return true;
 }
 
-bool DoRpcCall(const char* host, const char* method, BSONObj& arg, BSONObj* result)
+bool DoRpcCall(const char* host, const char* method, BSONObj& arg, BSONObj* result, std::string* errCode = NULL)
 {
 	boost::asio::io_service io_service;
 
@@ -153,7 +156,7 @@ bool DoRpcCall(const char* host, const char* method, BSONObj& arg, BSONObj* resu
 		return false;
 	}
 
-	int rpcResult = ReadRpcResponseHeader(s);
+	int rpcResult = ReadRpcResponseHeader(s, errCode);
 	if ( rpcResult == -1 )	//network error
 	{
 		s.close();
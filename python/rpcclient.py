@@ -39,18 +39,27 @@ class RpcError(Exception):
         return self.message,self.detail
 
 class BackendError(RpcError):
-    pass
+    """an error the server sent with a code"""
+
+    def __init__(self,code,detail,retry_after=None):
+        self.code = code
+        self.detail = detail
+        # seconds to wait before calling again, when the server says
+        self.retry_after = retry_after
+        RpcError.__init__(self,'%s: %s'%(code,detail))
 
 
 class Request(object):
     header = None
     body = None
-    def __init__(self,method,args):
+    def __init__(self,method,args,metadata=None):
         self._operation = 1
         self._method = method
         self.body = args
         self.header = {'operation':self._operation,
                         'method':self._method}
+        if metadata:
+            self.header['metadata'] = metadata
     
     def encode_request(self):
         try:
@@ -68,6 +77,21 @@ class Response(object):
     def error(self):
         return self.header.get('error')
 
+    @property
+    def code(self):
+        return self.header.get('code')
+
+    @property
+    def detail(self):
+        return self.header.get('detail','')
+
+    @property
+    def retry_after(self):
+        ms = self.header.get('retryafter')
+        if ms:
+            return ms / 1000.0
+        return None
+
     def decode_response(self,data):
         try:
             offset,self.header = decode_document(data,0)
@@ -127,8 +151,8 @@ class Connection(object):
             pass
         self._conn = None
 
-    def write_request(self,method,args):
-        request = Request(method,args)
+    def write_request(self,method,args,metadata=None):
+        request = Request(method,args,metadata)
         data = request.encode_request()
         try:
             self.conn.sendall(data)
@@ -181,9 +205,11 @@ class Connection(object):
 
 class RpcClient(object):
     """rpc client"""
-    def __init__(self,host='localhost',port=9090):
+    def __init__(self,host='localhost',port=9090,metadata=None):
+        """metadata is sent with every call, e.g. {'authorization':token}"""
         self.host = host
         self.port = port
+        self.metadata = metadata
         self.conn = Connection(self.host,self.port)
 
     def __getattr__(self,funcname):
@@ -194,8 +220,10 @@ class RpcClient(object):
     def __call__(self,method,args):
         if not isinstance(args,dict):
             raise RpcError("args should be dict type")
-        self.conn.write_request(method,args)
+        self.conn.write_request(method,args,self.metadata)
         res = self.conn.read_response()
+        if res.code:
+            raise BackendError(res.code,res.detail,res.retry_after)
         if res.error:
             raise RpcError(res.error)
         if res.reply.has_key('_'):
@@ -4,10 +4,27 @@
 package rpc
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"oocrpc/bson"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type Args struct {
@@ -32,33 +49,117 @@ func (t *Arith) Mul(args *Args, reply *Reply) error {
 
 func (t *Arith) Div(args *Args, reply *Reply) error {
 	if args.B == 0 {
-		return errors.New("divide by zero")
+		return BackendError{"DivideByZero", "divide by zero"}
 	}
 	reply.C = args.A / args.B
 	return nil
 }
 
+func (t *Arith) Error(args *Args, reply *Reply) error {
+	panic("ERROR")
+}
 
 func (t *Arith) NError(args *Args, reply *Reply) error {
 	return errors.New("normalerror")
 }
 
-func (t *Arith)SimpleValue(arg *int,reply *bool) error {
-    if *arg == 2 {
-        *reply = true
-    }
-    return nil
+func (t *Arith) SimpleValue(arg *int, reply *bool) error {
+	if *arg == 2 {
+		*reply = true
+	}
+	return nil
 }
 
-func startServer() {
-	newServer := NewServer("localhost", 9091)
+// sleep A milliseconds and answer B
+func (t *Arith) Sleep(args *Args, reply *Reply) error {
+	time.Sleep(time.Duration(args.A) * time.Millisecond)
+	reply.C = args.B
+	return nil
+}
+
+// answer the milliseconds left to the deadline the client sent
+func (t *Arith) Deadline(ctx context.Context, args *Args, reply *Reply) error {
+	info, ok := CallInfoFromContext(ctx)
+	if !ok || info.Service != "Arith" || info.Method != "Deadline" || info.RemoteAddr == nil {
+		return errors.New("bad call info")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		reply.C = int(time.Until(deadline) / time.Millisecond)
+	}
+	return nil
+}
+
+var waitDone = make(chan error, 1)
+
+// block until the call is cancelled
+func (t *Arith) Wait(ctx context.Context, args *Args, reply *Reply) error {
+	<-ctx.Done()
+	waitDone <- ctx.Err()
+	return ctx.Err()
+}
+
+// send the trace metadata back, failing when A is negative
+func (t *Arith) Trace(ctx context.Context, args *Args, reply *Reply) error {
+	info, _ := CallInfoFromContext(ctx)
+	SetMetadata(ctx, "trace", info.Metadata["trace"])
+	if args.A < 0 {
+		return BackendError{Code: "InvalidArgument", Detail: "negative"}
+	}
+	reply.C = args.A
+	return nil
+}
+
+var serverAddr string
+var once sync.Once
+
+// serve on an ephemeral port
+func serve(server *Server) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+	return l.Addr().String(), served
+}
+
+func listenAndServe() (*Server, string, chan error) {
+	newServer := NewServer()
 	newServer.Register(new(Arith))
-	newServer.Serv()
+	addr, served := serve(newServer)
+	return newServer, addr, served
+}
+
+func openConns(c *Client) []*conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*conn(nil), c.conns...)
+}
+
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *testLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.logs, "")
+}
+
+func startServer() {
+	_, serverAddr, _ = listenAndServe()
 }
 
 func TestServer(t *testing.T) {
-	go startServer()
-	client := New("localhost:9091")
+	once.Do(startServer)
+	client := New(serverAddr)
 
 	fmt.Println("string....")
 	// normal calls
@@ -115,15 +216,1703 @@ func TestServer(t *testing.T) {
 		t.Error("expected divide by zero error detail:", err.Error())
 	}
 
-    // SimpleValue
-    arg := 2
-    var rep bool
-    err = client.Call("Arith.SimpleValue",&arg,&rep)
-    if err != nil {
-        t.Error("SimpleValue Error")
-    } 
-    if !rep {
-        t.Error(" the rep should be true")
-    }
+	// SimpleValue
+	arg := 2
+	var rep bool
+	err = client.Call("Arith.SimpleValue", &arg, &rep)
+	if err != nil {
+		t.Error("SimpleValue Error")
+	}
+	if !rep {
+		t.Error(" the rep should be true")
+	}
+
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	once.Do(startServer)
+	client := New(serverAddr)
+	defer client.Close()
+
+	// later calls finish first, replies must still find their caller
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reply := new(Reply)
+			err := client.Call("Arith.Sleep", &Args{20 - i, i}, reply)
+			if err != nil {
+				t.Error("Sleep:", err)
+				return
+			}
+			if reply.C != i {
+				t.Errorf("Sleep: expected %d got %d", i, reply.C)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(openConns(client)); n != 1 {
+		t.Error("expected one connection, got", n)
+	}
+}
+
+// write a request header and body by hand
+func writeRaw(w io.Writer, header bson.M, args interface{}) error {
+	bys, err := bson.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(bys); err != nil {
+		return err
+	}
+	if bys, err = bson.Marshal(args); err != nil {
+		return err
+	}
+	_, err = w.Write(bys)
+	return err
+}
+
+func readRaw(r io.Reader, out interface{}) error {
+	msglen := make([]byte, 4)
+	if _, err := io.ReadFull(r, msglen); err != nil {
+		return err
+	}
+	b := make([]byte, binary.LittleEndian.Uint32(msglen))
+	copy(b, msglen)
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, out)
+}
+
+func TestPipelinedWithoutSeq(t *testing.T) {
+	once.Do(startServer)
+	c, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the first request is the slow one, its reply must still come first
+	w := bufio.NewWriter(c)
+	// no seq, the way old clients do it
+	writeRaw(w, bson.M{"operation": 1, "method": "Arith.Sleep"}, &Args{50, 1})
+	writeRaw(w, bson.M{"operation": 1, "method": "Arith.Sleep"}, &Args{0, 2})
+	if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(c)
+	for i := 1; i <= 2; i++ {
+		var header bson.M
+		reply := new(Reply)
+		if err = readRaw(r, &header); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := header["seq"]; ok {
+			t.Error("expected no seq in the response header")
+		}
+		if err = readRaw(r, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.C != i {
+			t.Errorf("expected reply %d got %d", i, reply.C)
+		}
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	once.Do(startServer)
+	client := New(serverAddr)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	reply := new(Reply)
+	err := client.CallContext(ctx, "Arith.Sleep", &Args{200, 1}, reply)
+	if err != context.DeadlineExceeded {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+
+	// the connection is out of service, the next call gets a fresh one
+	if len(openConns(client)) != 0 {
+		t.Error("expected the connection to be quarantined")
+	}
+	err = client.CallContext(context.Background(), "Arith.Add", &Args{1, 2}, reply)
+	if err != nil || reply.C != 3 {
+		t.Error("Add: expected 3, got", reply.C, err)
+	}
+
+	client.Timeout = 20 * time.Millisecond
+	err = client.Call("Arith.Sleep", &Args{200, 1}, reply)
+	if err != context.DeadlineExceeded {
+		t.Error("expected Timeout to apply, got", err)
+	}
+}
+
+func TestServerContext(t *testing.T) {
+	once.Do(startServer)
+	client := New(serverAddr)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply := new(Reply)
+	err := client.CallContext(ctx, "Arith.Deadline", &Args{}, reply)
+	if err != nil {
+		t.Fatal("Deadline:", err)
+	}
+	if reply.C <= 0 || reply.C > 1000 {
+		t.Error("expected the deadline to reach the server, got", reply.C)
+	}
+
+	// a client going away cancels its calls
+	c, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeRaw(c, bson.M{"operation": 1, "method": "Arith.Wait", "seq": 1}, &Args{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+	select {
+	case err = <-waitDone:
+		if err != context.Canceled {
+			t.Error("expected the call to be cancelled, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the call was not cancelled on disconnect")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	logger := new(testLogger)
+	server.ErrorLog = logger
+	addr, served := serve(server)
+	client := New(addr)
+	defer client.Close()
+	idle := New(addr)
+	defer idle.Close()
+	if err := idle.Call("Arith.Add", &Args{1, 2}, new(Reply)); err != nil {
+		t.Fatal("Add:", err)
+	}
+
+	// a call in flight is allowed to finish
+	done := make(chan error, 1)
+	reply := new(Reply)
+	go func() { done <- client.Call("Arith.Sleep", &Args{100, 7}, reply) }()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shut := make(chan error, 1)
+	go func() { shut <- server.Shutdown(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	// calls sent meanwhile don't run, and may be sent elsewhere
+	if err := client.Call("Arith.Add", &Args{1, 2}, new(Reply)); !errors.Is(err, ErrServerClosed) || !DefaultRetryable(err) {
+		t.Error("expected a retryable ErrServerClosed, got", err)
+	}
+	if err := <-shut; err != nil {
+		t.Error("Shutdown:", err)
+	}
+	if err := <-done; err != nil || reply.C != 7 {
+		t.Error("expected the running call to finish, got", reply.C, err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Error("expected ErrServerClosed, got", err)
+	}
+
+	// the idle client was told to go away
+	if len(openConns(idle)) != 0 {
+		t.Error("expected the idle connection to be retired")
+	}
+	if err := idle.Call("Arith.Add", &Args{1, 2}, new(Reply)); err == nil {
+		t.Error("expected calls to fail after shutdown")
+	}
+	// closing the connections is no error
+	if logs := logger.String(); logs != "" {
+		t.Error("expected nothing logged, got", logs)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server, addr, _ := listenAndServe()
+	client := New(addr)
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() { done <- client.Call("Arith.Wait", &Args{}, new(Reply)) }()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("expected Shutdown to time out, got", err)
+	}
+	// Close cancels the running call
+	server.Close()
+	if err := <-done; err == nil {
+		t.Error("expected the call to fail on Close")
+	}
+	if err := <-waitDone; err != context.Canceled {
+		t.Error("expected the call to be cancelled, got", err)
+	}
+}
+
+func TestListenAndServe(t *testing.T) {
+	server := NewServer()
+	if err := server.ListenAndServe("localhost:-1"); err == nil {
+		t.Error("expected a bad address to fail")
+	}
+	server.Close()
+	if err := server.ListenAndServe("127.0.0.1:0"); err != ErrServerClosed {
+		t.Error("expected ErrServerClosed, got", err)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	logger := new(testLogger)
+	server := NewServer()
+	server.ErrorLog = logger
+	server.Register(new(Arith))
+	addr, _ := serve(server)
+	defer server.Close()
+
+	client := New(addr)
+	defer client.Close()
+	err := client.Call("Arith.Error", &Args{7, 8}, new(Reply))
+	var be *BackendError
+	if !errors.As(err, &be) || be.Code != CodeInternalError {
+		t.Error("expected an internal error, got", err)
+	}
+	if !strings.Contains(logger.String(), "panic serving Arith.Error: ERROR") {
+		t.Error("expected the panic to be logged, got", logger.String())
+	}
+
+	// the connection is still good
+	conns := openConns(client)
+	reply := new(Reply)
+	if err = client.Call("Arith.Add", &Args{7, 8}, reply); err != nil || reply.C != 15 {
+		t.Error("Add: expected 15, got", reply.C, err)
+	}
+	if after := openConns(client); len(after) != 1 || after[0] != conns[0] {
+		t.Error("expected the connection to be reused")
+	}
+
+	// the header carries the code, old clients get it in order too
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writeRaw(c, bson.M{"operation": 1, "method": "Arith.Error"}, &Args{})
+	var header bson.M
+	if err = readRaw(c, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header["operation"] != 3 || header["code"] != CodeInternalError {
+		t.Error("expected an internal error header, got", header)
+	}
+}
+
+func TestBackendError(t *testing.T) {
+	once.Do(startServer)
+	client := New(serverAddr)
+	defer client.Close()
+
+	err := client.Call("Arith.Div", &Args{7, 0}, new(Reply))
+	var be *BackendError
+	if !errors.As(err, &be) {
+		t.Fatal("expected a *BackendError, got", err)
+	}
+	if be.Code != "DivideByZero" || be.Detail != "divide by zero" {
+		t.Error("unexpected error", be.Code, be.Detail)
+	}
+
+	// plain errors carry no code
+	err = client.Call("Arith.NError", &Args{7, 0}, new(Reply))
+	if err == nil || errors.As(err, &be) {
+		t.Error("expected a plain error, got", err)
+	}
+}
+
+func TestGo(t *testing.T) {
+	once.Do(startServer)
+	client := New(serverAddr)
+	defer client.Close()
+
+	done := make(chan *Call, 10)
+	for i := 0; i < 10; i++ {
+		client.Go("Arith.Sleep", &Args{10 - i, i}, new(Reply), done)
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < 10; i++ {
+		call := <-done
+		if call.Error != nil {
+			t.Fatal("Sleep:", call.Error)
+		}
+		if call.ServiceMethod != "Arith.Sleep" {
+			t.Error("unexpected method", call.ServiceMethod)
+		}
+		args, reply := call.Args.(*Args), call.Reply.(*Reply)
+		if reply.C != args.B {
+			t.Errorf("Sleep: expected %d got %d", args.B, reply.C)
+		}
+		seen[reply.C] = true
+	}
+	if len(seen) != 10 {
+		t.Error("expected 10 distinct replies, got", len(seen))
+	}
+
+	// errors and timeouts come through Done as well
+	call := <-client.Go("Arith.NError", &Args{}, new(Reply), nil).Done
+	if call.Error == nil || call.Error.Error() != "normalerror" {
+		t.Error("expected normalerror, got", call.Error)
+	}
+	client.Timeout = 20 * time.Millisecond
+	call = <-client.Go("Arith.Sleep", &Args{200, 1}, new(Reply), nil).Done
+	if call.Error != context.DeadlineExceeded {
+		t.Error("expected deadline exceeded, got", call.Error)
+	}
+}
+
+func TestDial(t *testing.T) {
+	once.Do(startServer)
+	if _, err := Dial("no-such-host.invalid:9091"); err == nil {
+		t.Error("expected Dial to fail on a bad address")
+	}
+	if _, err := Dial(serverAddr, WithNetwork("udp")); err == nil {
+		t.Error("expected Dial to fail on an unsupported network")
+	}
+	if _, err := Dial(serverAddr, WithNetwork("udp"), WithReResolve()); err == nil {
+		t.Error("expected Dial to fail on an unsupported network with WithReResolve")
+	}
+
+	// resolved when connecting, so only the call fails
+	client, err := Dial("no-such-host.invalid:9091", WithReResolve(), WithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	if err = client.Call("Arith.Add", &Args{1, 2}, new(Reply)); err == nil {
+		t.Error("expected the call to fail")
+	}
+
+	// busy connections make the pool grow up to its size
+	client, err = Dial(serverAddr, WithPoolSize(3), WithCallTimeout(time.Second))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer client.Close()
+	if client.Timeout != time.Second {
+		t.Error("expected the call timeout to be set")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.Call("Arith.Sleep", &Args{50, 1}, new(Reply)); err != nil {
+				t.Error("Sleep:", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(openConns(client)); n != 3 {
+		t.Error("expected 3 connections, got", n)
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+	path := t.TempDir() + "/rpc.sock"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("unix sockets not supported:", err)
+	}
+	server := NewServer()
+	server.Register(new(Arith))
+	go server.Serve(l)
+	defer server.Close()
+
+	client, err := Dial(path, WithNetwork("unix"))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer client.Close()
+	reply := new(Reply)
+	if err = client.Call("Arith.Add", &Args{1, 2}, reply); err != nil || reply.C != 3 {
+		t.Error("Add: expected 3, got", reply.C, err)
+	}
+}
+
+func TestPoolEviction(t *testing.T) {
+	once.Do(startServer)
+	client, err := Dial(serverAddr, WithIdleTimeout(30*time.Millisecond))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer client.Close()
+	if err = client.Call("Arith.Add", &Args{1, 2}, new(Reply)); err != nil {
+		t.Fatal("Add:", err)
+	}
+	if stats := client.Stats(); stats.OpenConnections != 1 || stats.Idle != 1 {
+		t.Errorf("expected one idle connection, got %+v", stats)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if stats := client.Stats(); stats.OpenConnections != 0 || stats.MaxIdleClosed != 1 {
+		t.Errorf("expected the idle connection to be closed, got %+v", stats)
+	}
+
+	// old connections are retired even when busy
+	client, err = Dial(serverAddr, WithMaxLifetime(30*time.Millisecond))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer client.Close()
+	reply := new(Reply)
+	if err = client.Call("Arith.Sleep", &Args{100, 1}, reply); err != nil || reply.C != 1 {
+		t.Fatal("Sleep: expected 1, got", reply.C, err)
+	}
+	if stats := client.Stats(); stats.OpenConnections != 0 || stats.MaxLifetimeClosed != 1 {
+		t.Errorf("expected the old connection to be retired, got %+v", stats)
+	}
+}
+
+func TestPoolWait(t *testing.T) {
+	once.Do(startServer)
+	client, err := Dial(serverAddr, WithMaxStreams(1))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.Call("Arith.Sleep", &Args{50, 1}, new(Reply)); err != nil {
+				t.Error("Sleep:", err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if stats := client.Stats(); stats.InUse != 1 || stats.InFlight != 1 || stats.Waiting != 2 {
+		t.Errorf("expected one call in flight and two waiting, got %+v", stats)
+	}
+	wg.Wait()
+	if stats := client.Stats(); stats.WaitCount != 2 || stats.Waiting != 0 {
+		t.Errorf("expected two calls to have waited, got %+v", stats)
+	}
+
+	// waiting gives up with the context
+	done := client.Go("Arith.Sleep", &Args{200, 1}, new(Reply), nil).Done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err = client.CallContext(ctx, "Arith.Add", &Args{1, 2}, new(Reply)); err != context.DeadlineExceeded {
+		t.Error("expected deadline exceeded, got", err)
+	}
+	if call := <-done; call.Error != nil {
+		t.Error("Sleep:", call.Error)
+	}
+}
+
+// counts the requests passing through the default codec
+type countingCodec struct {
+	ServerCodec
+	mu       sync.Mutex
+	requests int
+}
+
+func (c *countingCodec) ReadRequestHeader(req *Request) error {
+	err := c.ServerCodec.ReadRequestHeader(req)
+	c.mu.Lock()
+	c.requests++
+	c.mu.Unlock()
+	return err
+}
+
+func TestCodec(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	cli, srv := net.Pipe()
+	codec := &countingCodec{ServerCodec: NewServerCodec(srv)}
+	served := make(chan bool)
+	go func() {
+		server.ServeCodec(codec)
+		close(served)
+	}()
 
+	client := NewClientWithCodec(NewClientCodec(cli))
+	reply := new(Reply)
+	for i := 0; i < 3; i++ {
+		if err := client.Call("Arith.Add", &Args{i, 1}, reply); err != nil || reply.C != i+1 {
+			t.Error("Add: expected", i+1, "got", reply.C, err)
+		}
+	}
+	codec.mu.Lock()
+	if codec.requests != 3 {
+		t.Error("expected 3 requests through the codec, got", codec.requests)
+	}
+	codec.mu.Unlock()
+
+	// nothing to redial once the codec is gone
+	codec.Close()
+	<-served
+	if err := client.Call("Arith.Add", &Args{1, 2}, reply); err == nil {
+		t.Error("expected the call to fail")
+	}
+	if err := client.Call("Arith.Add", &Args{1, 2}, reply); err != ErrShutdown {
+		t.Error("expected ErrShutdown, got", err)
+	}
+}
+
+func TestServerInterceptors(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	var mu sync.Mutex
+	var trace []string
+	record := func(name string) ServerInterceptor {
+		return func(ctx context.Context, info *CallInfo, args, reply interface{}, next Handler) error {
+			mu.Lock()
+			trace = append(trace, name+" "+info.Service+"."+info.Method)
+			mu.Unlock()
+			return next(ctx, args, reply)
+		}
+	}
+	server.Use(record("first"), record("second"))
+	server.Use(func(ctx context.Context, info *CallInfo, args, reply interface{}, next Handler) error {
+		if info.Method == "Mul" {
+			return BackendError{"Denied", "no multiplication"}
+		}
+		err := next(ctx, args, reply)
+		if r, ok := reply.(*Reply); ok && err == nil {
+			r.C *= 10
+		}
+		return err
+	})
+	addr, _ := serve(server)
+	defer server.Close()
+
+	client := New(addr)
+	defer client.Close()
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", &Args{1, 2}, reply); err != nil || reply.C != 30 {
+		t.Error("Add: expected 30, got", reply.C, err)
+	}
+	err := client.Call("Arith.Mul", &Args{1, 2}, reply)
+	var be *BackendError
+	if !errors.As(err, &be) || be.Code != "Denied" {
+		t.Error("expected the call to be denied, got", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := "first Arith.Add,second Arith.Add,first Arith.Mul,second Arith.Mul"
+	if got := strings.Join(trace, ","); got != want {
+		t.Errorf("expected %q got %q", want, got)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	once.Do(startServer)
+	var mu sync.Mutex
+	var trace []string
+	var attempts int
+	timing := func(ctx context.Context, req *Request, args, reply interface{}, invoke Invoker) error {
+		start := time.Now()
+		err := invoke(ctx, req, args, reply)
+		mu.Lock()
+		trace = append(trace, fmt.Sprint(req.Method, " ", err == nil, " ", time.Since(start) > 0))
+		mu.Unlock()
+		return err
+	}
+	// short method names go to Arith, a failed call is tried once more
+	rewrite := func(ctx context.Context, req *Request, args, reply interface{}, invoke Invoker) error {
+		if !strings.Contains(req.Method, ".") {
+			req.Method = "Arith." + req.Method
+		}
+		err := invoke(ctx, req, args, reply)
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		if err != nil {
+			mu.Lock()
+			attempts++
+			mu.Unlock()
+			err = invoke(ctx, req, args, reply)
+		}
+		return err
+	}
+	client, err := Dial(serverAddr, WithInterceptors(timing, rewrite))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer client.Close()
+
+	reply := new(Reply)
+	if err = client.Call("Add", &Args{1, 2}, reply); err != nil || reply.C != 3 {
+		t.Error("Add: expected 3, got", reply.C, err)
+	}
+	if err = client.Call("NError", &Args{}, reply); err == nil {
+		t.Error("expected NError to fail")
+	}
+	call := <-client.Go("Mul", &Args{2, 3}, reply, nil).Done
+	if call.Error != nil || reply.C != 6 {
+		t.Error("Mul: expected 6, got", reply.C, call.Error)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "Arith.Add true true,Arith.NError false true,Arith.Mul true true"
+	if got := strings.Join(trace, ","); got != want {
+		t.Errorf("expected %q got %q", want, got)
+	}
+	if attempts != 4 {
+		t.Error("expected 4 attempts, got", attempts)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	once.Do(startServer)
+	client := New(serverAddr)
+	defer client.Close()
+
+	var md Metadata
+	reply := new(Reply)
+	err := client.CallContext(context.Background(), "Arith.Trace", &Args{1, 0}, reply,
+		WithMetadata(Metadata{"trace": "abc"}), ReplyMetadata(&md))
+	if err != nil || reply.C != 1 {
+		t.Fatal("Trace:", reply.C, err)
+	}
+	if md["trace"] != "abc" {
+		t.Error("expected trace abc, got", md)
+	}
+
+	// metadata comes back with errors too
+	md = nil
+	err = client.CallContext(context.Background(), "Arith.Trace", &Args{-1, 0}, reply,
+		WithMetadata(Metadata{"trace": "def"}), ReplyMetadata(&md))
+	var be *BackendError
+	if !errors.As(err, &be) || be.Code != "InvalidArgument" {
+		t.Error("expected InvalidArgument, got", err)
+	}
+	if md["trace"] != "def" {
+		t.Error("expected trace def, got", md)
+	}
+
+	// and on async calls
+	call := client.Go("Arith.Trace", &Args{2, 0}, reply, nil)
+	<-call.Done
+	if call.Error != nil || call.Metadata["trace"] != "" {
+		t.Error("Go:", call.Metadata, call.Error)
+	}
+
+	// interceptors can add to it
+	tag := func(ctx context.Context, req *Request, args, reply interface{}, invoke Invoker) error {
+		if req.Metadata == nil {
+			req.Metadata = Metadata{}
+		}
+		req.Metadata["trace"] = "tagged"
+		return invoke(ctx, req, args, reply)
+	}
+	tagged, err := Dial(serverAddr, WithInterceptors(tag))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer tagged.Close()
+	if err = tagged.CallContext(context.Background(), "Arith.Trace", &Args{3, 0}, reply, ReplyMetadata(&md)); err != nil || md["trace"] != "tagged" {
+		t.Error("expected trace tagged, got", md, err)
+	}
 }
+
+// drops connections once they have read a request, while drops is positive
+type flakyListener struct {
+	net.Listener
+	drops int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &flakyConn{c, l}, nil
+}
+
+type flakyConn struct {
+	net.Conn
+	l *flakyListener
+}
+
+func (c *flakyConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && atomic.AddInt32(&c.l.drops, -1) >= 0 {
+		c.Conn.Close()
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func TestRetry(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.MarkIdempotent("Arith.Mul")
+	server.ErrorLog = new(testLogger)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl := &flakyListener{Listener: l}
+	go server.Serve(fl)
+	defer server.Close()
+	drop := func() { atomic.StoreInt32(&fl.drops, 1) }
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: 0.5}
+	client, err := Dial(l.Addr().String(), WithRetryPolicy(policy))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer client.Close()
+
+	// the server has not marked Mul yet as far as the client knows
+	drop()
+	reply := new(Reply)
+	if err = client.Call("Arith.Mul", &Args{2, 3}, reply); err == nil {
+		t.Fatal("expected the dropped Mul to fail")
+	}
+	if err = client.Call("Arith.Mul", &Args{2, 3}, reply); err != nil || reply.C != 6 {
+		t.Fatal("Mul: expected 6, got", reply.C, err)
+	}
+	// now it does
+	drop()
+	if err = client.Call("Arith.Mul", &Args{3, 3}, reply); err != nil || reply.C != 9 {
+		t.Error("expected Mul to be retried, got", reply.C, err)
+	}
+	// Add may have run, it is not sent twice
+	drop()
+	if err = client.Call("Arith.Add", &Args{3, 3}, reply); err == nil {
+		t.Error("expected the dropped Add to fail")
+	}
+	// server errors are not retried
+	if err = client.Call("Arith.NError", &Args{}, reply); err == nil || err.Error() != "normalerror" {
+		t.Error("expected normalerror, got", err)
+	}
+
+	// methods can be listed as idempotent up front
+	policy.Idempotent = []string{"Arith.Add"}
+	listed, err := Dial(l.Addr().String(), WithRetryPolicy(policy))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer listed.Close()
+	drop()
+	if err = listed.Call("Arith.Add", &Args{3, 4}, reply); err != nil || reply.C != 7 {
+		t.Error("expected Add to be retried, got", reply.C, err)
+	}
+	// Go retries without a goroutine waiting on the call
+	drop()
+	if call := <-listed.Go("Arith.Add", &Args{4, 4}, reply, nil).Done; call.Error != nil || reply.C != 8 {
+		t.Error("expected Go to retry Add, got", reply.C, call.Error)
+	}
+	drop()
+	if call := <-client.Go("Arith.Add", &Args{4, 5}, reply, nil).Done; call.Error == nil {
+		t.Error("expected the dropped Go Add to fail")
+	}
+
+	// calls that never left the client are retried whatever the method
+	l.Close()
+	var tries int32
+	policy.Retryable = func(err error) bool {
+		atomic.AddInt32(&tries, 1)
+		return DefaultRetryable(err)
+	}
+	down, err := Dial(l.Addr().String(), WithRetryPolicy(policy))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer down.Close()
+	if err = down.Call("Arith.Div", &Args{1, 1}, reply); err == nil {
+		t.Error("expected the dial to fail")
+	}
+	if tries != 2 {
+		t.Error("expected 2 retries, got", tries)
+	}
+
+	// errors of the client itself would come back the same way
+	atomic.StoreInt32(&tries, 0)
+	noCreds := func(ctx context.Context, req *Request) error { return errors.New("no token") }
+	unsigned, err := Dial(l.Addr().String(), WithRetryPolicy(policy), WithCredentials(noCreds))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer unsigned.Close()
+	if err = unsigned.Call("Arith.Add", &Args{1, 1}, reply); err == nil || tries != 1 {
+		t.Error("expected the credentials error once, got", err, tries)
+	}
+}
+
+type Inner struct {
+	Depth int
+}
+
+type Tagged struct {
+	ID    string `bson:"_id"`
+	Count int64  `bson:",omitempty"`
+	Skip  int    `bson:"-"`
+	Inner `bson:",inline"`
+	Next  *Tagged
+	Tags  map[string][]string
+}
+
+type Schema int
+
+func (s *Schema) Echo(args *Tagged, reply *Tagged) error {
+	*reply = *args
+	return nil
+}
+
+func TestReflection(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.Register(new(Schema))
+	addr, _ := serve(server)
+	defer server.Close()
+	client := New(addr)
+	defer client.Close()
+
+	list := new(ServiceList)
+	if err := client.Call("_rpc.ListServices", &struct{}{}, list); err != nil {
+		t.Fatal("ListServices:", err)
+	}
+	if got := strings.Join(list.Services, ","); got != "Arith,Schema,_rpc" {
+		t.Error("unexpected services", got)
+	}
+
+	desc := new(Description)
+	if err := client.Call("_rpc.Describe", &DescribeArgs{"Schema"}, desc); err != nil {
+		t.Fatal("Describe:", err)
+	}
+	if len(desc.Services) != 1 || len(desc.Services[0].Methods) != 1 {
+		t.Fatal("unexpected description", desc)
+	}
+	m := desc.Services[0].Methods[0]
+	if m.Name != "Echo" || m.Args.Name != "rpc.Tagged" || m.Args.Kind != "struct" {
+		t.Fatal("unexpected method", m.Name, m.Args)
+	}
+	var fields []string
+	for _, f := range m.Args.Fields {
+		fields = append(fields, fmt.Sprint(f.Key, ":", f.Type.Kind, ":", f.OmitEmpty))
+	}
+	want := "_id:string:false,count:int64:true,depth:int:false,next:struct:false,tags:map:false"
+	if got := strings.Join(fields, ","); got != want {
+		t.Errorf("expected %q got %q", want, got)
+	}
+	next, tags := m.Args.Fields[3].Type, m.Args.Fields[4].Type
+	if next.Name != "rpc.Tagged" || len(next.Fields) != 0 {
+		t.Error("expected the cycle to stop at next, got", next)
+	}
+	if tags.Key.Kind != "string" || tags.Elem.Kind != "slice" || tags.Elem.Elem.Kind != "string" {
+		t.Error("unexpected map schema", tags.Key, tags.Elem)
+	}
+
+	// every service, and none by the name of a method
+	desc = new(Description)
+	if err := client.Call("_rpc.Describe", &DescribeArgs{}, desc); err != nil || len(desc.Services) != 3 {
+		t.Error("Describe all:", len(desc.Services), err)
+	}
+	if err := client.Call("_rpc.Describe", &DescribeArgs{"Nope"}, desc); err == nil {
+		t.Error("expected an unknown service to fail")
+	}
+	if err := client.Call("Describe", &DescribeArgs{}, desc); err == nil {
+		t.Error("expected the reflection methods to need the service name")
+	}
+}
+
+// a certificate for name signed by parent, self-signed when parent is nil
+func newCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLS(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	server := NewServer()
+	server.Register(new(Arith))
+	server.ErrorLog = new(testLogger)
+	server.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{newCert(t, "localhost", &ca)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	peers := make(chan string, 1)
+	server.Use(func(ctx context.Context, info *CallInfo, args, reply interface{}, next Handler) error {
+		if info.TLS == nil || info.PeerCertificate == nil {
+			return errors.New("no peer certificate")
+		}
+		peers <- info.PeerCertificate.Subject.CommonName
+		return next(ctx, args, reply)
+	})
+	addr, _ := serve(server)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(addr)
+	target := "localhost:" + port
+
+	client, err := Dial(target, WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{newCert(t, "alice", &ca)},
+		RootCAs:      pool,
+	}))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer client.Close()
+	reply := new(Reply)
+	if err = client.Call("Arith.Add", &Args{7, 8}, reply); err != nil || reply.C != 15 {
+		t.Fatal("Add: expected 15, got", reply.C, err)
+	}
+	if peer := <-peers; peer != "alice" {
+		t.Error("expected peer alice, got", peer)
+	}
+
+	// no client certificate, an unknown server, no TLS at all
+	for _, opt := range []DialOption{
+		WithTLSConfig(&tls.Config{RootCAs: pool}),
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{newCert(t, "bob", &ca)}}),
+		WithCallTimeout(time.Second),
+	} {
+		c, err := Dial(target, opt)
+		if err != nil {
+			t.Fatal("Dial:", err)
+		}
+		if err = c.Call("Arith.Add", &Args{7, 8}, reply); err == nil {
+			t.Error("expected the call to fail")
+		}
+		c.Close()
+	}
+	select {
+	case peer := <-peers:
+		t.Error("unexpected call from", peer)
+	default:
+	}
+
+	// a client stuck in the handshake is closed with the server
+	stuck, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	time.Sleep(10 * time.Millisecond)
+	server.Close()
+	stuck.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = stuck.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("expected the connection closed, got", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	principals := make(chan string, 1)
+	start := func(a Authenticator) string {
+		server := NewServer()
+		server.Register(new(Arith))
+		server.Authenticator = a
+		server.Use(func(ctx context.Context, info *CallInfo, args, reply interface{}, next Handler) error {
+			principals <- info.Principal
+			return next(ctx, args, reply)
+		})
+		addr, _ := serve(server)
+		t.Cleanup(func() { server.Close() })
+		return addr
+	}
+	unauthenticated := func(err error) bool {
+		var be *BackendError
+		return errors.As(err, &be) && be.Code == CodeUnauthenticated
+	}
+
+	addr := start(NewTokenAuthenticator(map[string]string{"s3cret": "alice"}))
+	reply := new(Reply)
+	for _, token := range []string{"", "wrong"} {
+		c, _ := Dial(addr, WithCredentials(TokenCredentials(token)))
+		if err := c.Call("Arith.Add", &Args{1, 2}, reply); !unauthenticated(err) {
+			t.Errorf("token %q: expected Unauthenticated, got %v", token, err)
+		}
+		// nor does it tell which methods exist
+		if err := c.Call("Arith.Nope", &Args{1, 2}, reply); !unauthenticated(err) {
+			t.Errorf("token %q: expected Unauthenticated for an unknown method, got %v", token, err)
+		}
+		c.Close()
+	}
+	c, _ := Dial(addr, WithCredentials(TokenCredentials("s3cret")))
+	if err := c.Call("Arith.Nope", &Args{1, 2}, reply); err == nil || !strings.Contains(err.Error(), "can not find method") {
+		t.Error("expected an unknown method, got", err)
+	}
+	if err := c.Call("Arith.Add", &Args{1, 2}, reply); err != nil || reply.C != 3 {
+		t.Fatal("Add: expected 3, got", reply.C, err)
+	}
+	if p := <-principals; p != "alice" {
+		t.Error("expected alice, got", p)
+	}
+	c.Close()
+
+	addr = start(NewHMACAuthenticator(map[string][]byte{"bob": []byte("key")}, time.Minute))
+	c, _ = Dial(addr, WithCredentials(HMACCredentials("bob", []byte("key"))))
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if err := c.Call("Arith.Add", &Args{i, 2}, reply); err != nil || reply.C != i+2 {
+			t.Fatal("Add:", reply.C, err)
+		}
+		if p := <-principals; p != "bob" {
+			t.Error("expected bob, got", p)
+		}
+	}
+
+	// a wrong secret, a signature for another method and a replay
+	var signed Metadata
+	capture := func(ctx context.Context, req *Request) error {
+		if signed == nil {
+			HMACCredentials("bob", []byte("key"))(ctx, req)
+			signed = req.Metadata
+		}
+		for k, v := range signed {
+			req.Metadata[k] = v
+		}
+		return nil
+	}
+	replay, _ := Dial(addr, WithCredentials(capture))
+	defer replay.Close()
+	if err := replay.Call("Arith.Add", &Args{1, 1}, reply); err != nil {
+		t.Fatal("first use:", err)
+	}
+	<-principals
+	if err := replay.Call("Arith.Add", &Args{1, 1}, reply); !unauthenticated(err) || !strings.Contains(err.Error(), "replayed") {
+		t.Error("expected the replay to be rejected, got", err)
+	}
+	if err := replay.Call("Arith.Mul", &Args{1, 1}, reply); !unauthenticated(err) {
+		t.Error("expected the signature not to cover Mul, got", err)
+	}
+	wrong, _ := Dial(addr, WithCredentials(HMACCredentials("bob", []byte("nope"))))
+	defer wrong.Close()
+	if err := wrong.Call("Arith.Add", &Args{1, 1}, reply); !unauthenticated(err) {
+		t.Error("expected a wrong secret to be rejected, got", err)
+	}
+}
+
+func TestACL(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.Authenticator = NewTokenAuthenticator(map[string]string{"a": "alice", "o": "ops"})
+	if err := server.SetACL(ACL{"Nope.*": {"ops"}}); err == nil {
+		t.Error("expected an unknown service to be refused")
+	}
+	if err := server.SetACL(ACL{"Arith.Nope": {"ops"}}); err == nil {
+		t.Error("expected an unknown method to be refused")
+	}
+	err := server.SetACL(ACL{
+		"Arith.Add": {"*"},
+		"Arith.*":   {"ops"},
+		"_rpc.*":    {"alice", "ops"},
+	})
+	if err != nil {
+		t.Fatal("SetACL:", err)
+	}
+	addr, _ := serve(server)
+	defer server.Close()
+	alice, _ := Dial(addr, WithCredentials(TokenCredentials("a")))
+	defer alice.Close()
+	ops, _ := Dial(addr, WithCredentials(TokenCredentials("o")))
+	defer ops.Close()
+
+	denied := func(err error) bool {
+		var be *BackendError
+		return errors.As(err, &be) && be.Code == CodePermissionDenied
+	}
+	reply := new(Reply)
+	if err := alice.Call("Arith.Add", &Args{1, 2}, reply); err != nil {
+		t.Error("alice Add:", err)
+	}
+	if err := alice.Call("Arith.Mul", &Args{1, 2}, reply); !denied(err) || err.Error() != "rpc.PermissionDenied: alice may not call Arith.Mul" {
+		t.Error("expected alice Mul to be denied, got", err)
+	}
+	if err := ops.Call("Arith.Mul", &Args{1, 2}, reply); err != nil {
+		t.Error("ops Mul:", err)
+	}
+	if err := alice.Call("_rpc.ListServices", &struct{}{}, new(ServiceList)); err != nil {
+		t.Error("alice ListServices:", err)
+	}
+
+	// lifting it
+	server.SetACL(nil)
+	if err := alice.Call("Arith.Mul", &Args{1, 2}, reply); err != nil {
+		t.Error("alice Mul without an acl:", err)
+	}
+}
+
+// a resolver the test changes
+type testResolver struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (r *testResolver) set(addrs ...string) {
+	r.mu.Lock()
+	r.addrs = addrs
+	r.mu.Unlock()
+}
+
+func (r *testResolver) Resolve(ctx context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.addrs...), nil
+}
+
+func TestBalancer(t *testing.T) {
+	// every backend tags its replies with its address
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		server := NewServer()
+		server.Register(new(Arith))
+		addr, _ := serve(server)
+		server.Use(func(ctx context.Context, info *CallInfo, args, reply interface{}, next Handler) error {
+			SetMetadata(ctx, "backend", addr)
+			return next(ctx, args, reply)
+		})
+		defer server.Close()
+		addrs = append(addrs, addr)
+	}
+	served := func(b *BalancedClient, n int, opts ...CallOption) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			var md Metadata
+			err := b.CallContext(context.Background(), "Arith.Add", &Args{i, 1}, new(Reply), append(opts, ReplyMetadata(&md))...)
+			if err != nil {
+				t.Fatal("Add:", err)
+			}
+			counts[md["backend"]]++
+		}
+		return counts
+	}
+
+	b, err := DialBalanced(StaticResolver(addrs))
+	if err != nil {
+		t.Fatal("DialBalanced:", err)
+	}
+	defer b.Close()
+	if counts := served(b, 9); len(counts) != 3 || counts[addrs[0]] != 3 || counts[addrs[1]] != 3 {
+		t.Error("expected round robin, got", counts)
+	}
+
+	hashed, _ := DialBalanced(StaticResolver(addrs), WithBalancePolicy(ConsistentHash))
+	defer hashed.Close()
+	if counts := served(hashed, 5, WithCallKey("user-42")); len(counts) != 1 {
+		t.Error("expected one backend for one key, got", counts)
+	}
+	keys := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		var md Metadata
+		hashed.CallContext(context.Background(), "Arith.Add", &Args{}, new(Reply), WithCallKey(fmt.Sprint("user-", i)), ReplyMetadata(&md))
+		keys[md["backend"]] = true
+	}
+	if len(keys) < 2 {
+		t.Error("expected keys to spread, got", keys)
+	}
+
+	// the busy backend is avoided
+	least, _ := DialBalanced(StaticResolver(addrs[:2]), WithBalancePolicy(LeastOutstanding))
+	defer least.Close()
+	slow := least.Go("Arith.Sleep", &Args{200, 0}, new(Reply), nil)
+	time.Sleep(20 * time.Millisecond)
+	if counts := served(least, 4); len(counts) != 1 {
+		t.Error("expected the idle backend only, got", counts)
+	}
+	<-slow.Done
+
+	// a dead backend is ejected
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := l.Addr().String()
+	l.Close()
+	r := &testResolver{}
+	r.set(dead, addrs[0])
+	ejecting, _ := DialBalanced(r, WithEjection(2, time.Minute), WithResolveInterval(10*time.Millisecond))
+	defer ejecting.Close()
+	failed := 0
+	for i := 0; i < 10; i++ {
+		if ejecting.Call("Arith.Add", &Args{}, new(Reply)) != nil {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Error("expected 2 failures before the ejection, got", failed)
+	}
+
+	// and so is one that hangs
+	hung, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer hung.Close()
+	go func() {
+		for {
+			c, err := hung.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	timing, _ := DialBalanced(StaticResolver{hung.Addr().String(), addrs[0]},
+		WithEjection(2, time.Minute), WithBackendOptions(WithCallTimeout(20*time.Millisecond)))
+	defer timing.Close()
+	failed = 0
+	for i := 0; i < 10; i++ {
+		if timing.Call("Arith.Add", &Args{}, new(Reply)) != nil {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Error("expected 2 timeouts before the ejection, got", failed)
+	}
+
+	// and the resolver's changes are picked up
+	r.set(addrs[1], addrs[2])
+	for i := 0; i < 100 && strings.Join(ejecting.Backends(), ",") != addrs[1]+","+addrs[2]; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if counts := served(ejecting, 4); len(counts) != 2 || counts[addrs[0]] != 0 {
+		t.Error("expected the new backends, got", counts)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var mu sync.Mutex
+	var transitions []string
+	record := func(endpoint string, from, to CircuitState) {
+		mu.Lock()
+		transitions = append(transitions, fmt.Sprint(endpoint == addr, " ", from, ">", to))
+		mu.Unlock()
+	}
+	client, err := Dial(addr, WithCircuitBreaker(BreakerConfig{
+		ConsecutiveFailures: 2,
+		OpenTimeout:         50 * time.Millisecond,
+		OnStateChange:       record,
+	}))
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer client.Close()
+	reply := new(Reply)
+	for i := 0; i < 2; i++ {
+		if err = client.Call("Arith.Add", &Args{1, 2}, reply); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatal("expected a dial error, got", err)
+		}
+	}
+	if err = client.Call("Arith.Add", &Args{1, 2}, reply); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("expected ErrCircuitOpen, got", err)
+	}
+	if call := <-client.Go("Arith.Add", &Args{1, 2}, reply, nil).Done; !errors.Is(call.Error, ErrCircuitOpen) {
+		t.Fatal("expected ErrCircuitOpen from Go, got", call.Error)
+	}
+	if client.CircuitState() != CircuitOpen {
+		t.Error("expected open, got", client.CircuitState())
+	}
+
+	// the server comes back, after the timeout a trial call closes it
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("can't listen on", addr, "again:", err)
+	}
+	server := NewServer()
+	server.Register(new(Arith))
+	go server.Serve(l)
+	defer server.Close()
+	time.Sleep(60 * time.Millisecond)
+	if call := <-client.Go("Arith.Add", &Args{1, 2}, reply, nil).Done; call.Error != nil || reply.C != 3 {
+		t.Fatal("expected the trial call to succeed, got", reply.C, call.Error)
+	}
+	mu.Lock()
+	want := "true closed>open,true open>half-open,true half-open>closed"
+	if got := strings.Join(transitions, ","); got != want {
+		t.Errorf("expected %q got %q", want, got)
+	}
+	mu.Unlock()
+
+	// it also opens on the error rate, here of server errors
+	rated, _ := Dial(addr, WithCircuitBreaker(BreakerConfig{
+		ConsecutiveFailures: 100,
+		ErrorRate:           0.5,
+		MinCalls:            4,
+		IsFailure:           func(err error) bool { return err != nil },
+	}))
+	defer rated.Close()
+	for i := 0; i < 4; i++ {
+		method := "Arith.Add"
+		if i%2 == 1 {
+			method = "Arith.NError"
+		}
+		rated.Call(method, &Args{}, reply)
+	}
+	if err = rated.Call("Arith.Add", &Args{}, reply); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected the error rate to open it, got", err)
+	}
+
+	// only trials that ran to the end decide the half open state
+	c := new(Client)
+	WithCircuitBreaker(BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Millisecond})(c)
+	b := c.breaker
+	early, _ := b.allow("")
+	late, _ := b.allow("")
+	b.done("", early, io.ErrUnexpectedEOF)
+	time.Sleep(2 * time.Millisecond)
+	trial, ok := b.allow("")
+	if !ok {
+		t.Fatal("expected a trial call")
+	}
+	b.done("", late, nil)
+	b.done("", trial, context.Canceled)
+	if state := c.CircuitState(); state != CircuitHalfOpen {
+		t.Fatal("expected half-open after a stale success and a cancelled trial, got", state)
+	}
+	if trial, ok = b.allow(""); !ok {
+		t.Fatal("expected another trial call")
+	}
+	b.done("", trial, nil)
+	if state := c.CircuitState(); state != CircuitClosed {
+		t.Error("expected closed, got", state)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.SetLimits(Limits{MethodCalls: map[string]int{"Arith.Sleep": 1}, Reject: true})
+	addr, _ := serve(server)
+	defer server.Close()
+	client := New(addr)
+	defer client.Close()
+
+	slow := client.Go("Arith.Sleep", &Args{100, 0}, new(Reply), nil)
+	time.Sleep(20 * time.Millisecond)
+	reply := new(Reply)
+	var be *BackendError
+	if err := client.Call("Arith.Sleep", &Args{0, 1}, reply); !errors.As(err, &be) || be.Code != CodeOverloaded {
+		t.Error("expected Overloaded, got", err)
+	}
+	if err := client.Call("Arith.Add", &Args{1, 2}, reply); err != nil {
+		t.Error("Add:", err)
+	}
+	// it never ran, so it is retried although Sleep is not idempotent
+	retrying, _ := Dial(addr, WithRetryPolicy(RetryPolicy{MaxAttempts: 20, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}))
+	defer retrying.Close()
+	if err := retrying.Call("Arith.Sleep", &Args{0, 1}, reply); err != nil || reply.C != 1 {
+		t.Error("expected the retry to get through, got", reply.C, err)
+	}
+	<-slow.Done
+
+	// waiting instead, server wide and per connection
+	for _, l := range []Limits{{MaxCalls: 1}, {MaxConnCalls: 1}} {
+		server.SetLimits(l)
+		c, _ := Dial(addr)
+		start := time.Now()
+		calls := make([]*Call, 3)
+		for i := range calls {
+			calls[i] = c.Go("Arith.Sleep", &Args{30, i}, new(Reply), nil)
+		}
+		for i, call := range calls {
+			<-call.Done
+			if call.Error != nil || call.Reply.(*Reply).C != i {
+				t.Error(l, "Sleep:", call.Error)
+			}
+		}
+		if d := time.Since(start); d < 90*time.Millisecond {
+			t.Error(l, "expected the calls to run one at a time, took", d)
+		}
+		c.Close()
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.SetRateLimits(RateLimit{Key: ByRemoteAddr, Method: "Arith.Mul", Rate: 10, Burst: 2})
+	addr, _ := serve(server)
+	defer server.Close()
+	client := New(addr)
+	defer client.Close()
+
+	reply := new(Reply)
+	for i := 0; i < 2; i++ {
+		if err := client.Call("Arith.Mul", &Args{2, 3}, reply); err != nil {
+			t.Fatal("Mul within the burst:", err)
+		}
+	}
+	err := client.Call("Arith.Mul", &Args{2, 3}, reply)
+	var ra *RetryAfterError
+	if !errors.As(err, &ra) || ra.Code != CodeRateLimited || ra.RetryAfter <= 0 || ra.RetryAfter > 100*time.Millisecond {
+		t.Fatal("expected RateLimited with a hint, got", err)
+	}
+	var be *BackendError
+	if !errors.As(err, &be) || be.Code != CodeRateLimited {
+		t.Error("expected a *BackendError too, got", err)
+	}
+	// other methods aren't limited
+	if err = client.Call("Arith.Add", &Args{2, 3}, reply); err != nil {
+		t.Error("Add:", err)
+	}
+	// the hint is honoured by the retry policy
+	retrying, _ := Dial(addr, WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}))
+	defer retrying.Close()
+	start := time.Now()
+	if err = retrying.Call("Arith.Mul", &Args{2, 3}, reply); err != nil {
+		t.Error("expected the retry to get through, got", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Error("expected the retry to wait for the hint, took", d)
+	}
+	// a server over its limit is up, the circuit stays closed
+	breaking, _ := Dial(addr, WithCircuitBreaker(BreakerConfig{ConsecutiveFailures: 1}))
+	defer breaking.Close()
+	for i := 0; i < 3; i++ {
+		breaking.Call("Arith.Mul", &Args{2, 3}, reply)
+	}
+	if state := breaking.CircuitState(); state != CircuitClosed {
+		t.Error("expected the circuit closed, got", state)
+	}
+
+	// changed at runtime, per principal now
+	server.SetRateLimits(RateLimit{Key: ByPrincipal, Rate: 1})
+	if err = client.Call("Arith.Add", &Args{2, 3}, reply); err != nil {
+		t.Error("Add:", err)
+	}
+	if err = client.Call("Arith.Add", &Args{2, 3}, reply); !errors.As(err, &ra) {
+		t.Error("expected the second Add to be limited, got", err)
+	}
+	// a call rejected by one limit takes nothing from the others
+	server.SetRateLimits(RateLimit{Key: ByRemoteAddr, Rate: 1, Burst: 2}, RateLimit{Key: ByMethod, Method: "Arith.Mul", Rate: 1})
+	if err = client.Call("Arith.Mul", &Args{2, 3}, reply); err != nil {
+		t.Error("Mul:", err)
+	}
+	if err = client.Call("Arith.Mul", &Args{2, 3}, reply); !errors.As(err, &ra) {
+		t.Error("expected the second Mul to be limited, got", err)
+	}
+	if err = client.Call("Arith.Add", &Args{2, 3}, reply); err != nil {
+		t.Error("Add:", err)
+	}
+	server.SetRateLimits()
+	if err = client.Call("Arith.Mul", &Args{2, 3}, reply); err != nil {
+		t.Error("expected no limits, got", err)
+	}
+
+	// calls are counted by address before they are authenticated
+	guarded := NewServer()
+	guarded.Register(new(Arith))
+	guarded.Authenticator = NewTokenAuthenticator(map[string]string{"secret": "alice"})
+	guarded.SetRateLimits(RateLimit{Key: ByRemoteAddr, Rate: 1})
+	addr, _ = serve(guarded)
+	defer guarded.Close()
+	guessing := New(addr)
+	defer guessing.Close()
+	if err = guessing.Call("Arith.Add", &Args{2, 3}, reply); !errors.As(err, &be) || be.Code != CodeUnauthenticated {
+		t.Error("expected Unauthenticated, got", err)
+	}
+	if err = guessing.Call("Arith.Add", &Args{2, 3}, reply); !errors.As(err, &ra) {
+		t.Error("expected the second guess to be limited, got", err)
+	}
+	// methods that don't exist are no way around it
+	guarded.SetRateLimits(RateLimit{Key: ByRemoteAddr, Rate: 1})
+	if err = guessing.Call("Arith.Nope", &Args{2, 3}, reply); !errors.As(err, &be) || be.Code != CodeUnauthenticated {
+		t.Error("expected Unauthenticated, got", err)
+	}
+	if err = guessing.Call("Arith.Nope", &Args{2, 3}, reply); !errors.As(err, &ra) {
+		t.Error("expected the second guess at an unknown method to be limited, got", err)
+	}
+}
+
+// a length prefix and whatever follows it
+func frame(length uint32, rest ...byte) []byte {
+	b := make([]byte, 4, 4+len(rest))
+	binary.LittleEndian.PutUint32(b, length)
+	return append(b, rest...)
+}
+
+func TestFrameLimits(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.MaxBodySize = 64
+	logger := new(testLogger)
+	server.ErrorLog = logger
+	addr, _ := serve(server)
+	defer server.Close()
+
+	var header bytes.Buffer
+	writeRaw(&header, bson.M{"operation": 1, "method": "Arith.Add", "seq": 1}, &Args{1, 2})
+	valid := header.Bytes()
+	hdr, _ := bson.Marshal(bson.M{"operation": 1, "method": "Arith.Add", "seq": 1})
+	hdr = hdr[:len(hdr):len(hdr)] // appended to twice
+	unterminated := append([]byte(nil), hdr...)
+	unterminated[len(unterminated)-1] = 1
+	for name, b := range map[string][]byte{
+		"short header":        frame(3),
+		"huge header":         frame(0xffffffff),
+		"header over limit":   frame(DefaultMaxHeaderSize + 1),
+		"unterminated header": unterminated,
+		"body over limit":     append(hdr, frame(65)...),
+		"short body":          append(hdr, frame(4)...),
+	} {
+		withHeader := strings.Contains(name, "body")
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a good call first, then the broken frame
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		r := bufio.NewReader(c)
+		res, reply := new(Response), new(Reply)
+		c.Write(valid)
+		if err = readRaw(r, res); err != nil || readRaw(r, reply) != nil || reply.C != 3 {
+			t.Error(name+": expected the good call to work, got", err, reply.C)
+		}
+		c.Write(b)
+		if withHeader {
+			// the call is failed before the connection is closed
+			if err = readRaw(r, res); err != nil || res.Code != CodeProtocolError || res.Seq != 1 {
+				t.Error(name+": expected a protocol error, got", err, res)
+			}
+			readRaw(r, new(bson.M))
+		}
+		if _, err = r.ReadByte(); err != io.EOF {
+			t.Error(name+": expected the connection closed, got", err)
+		}
+		c.Close()
+	}
+	if !strings.Contains(logger.String(), ErrProtocol.Error()) {
+		t.Error("expected protocol errors logged, got", logger.String())
+	}
+
+	// the client has limits of its own, a reply over them fails the connection
+	client, _ := Dial(addr, WithMaxMessageSize(0, 8))
+	defer client.Close()
+	err := client.Call("Arith.Add", &Args{1, 2}, new(Reply))
+	if !errors.Is(err, ErrProtocol) {
+		t.Error("expected a protocol error, got", err)
+	}
+	var tries int32
+	retrying, _ := Dial(addr, WithMaxMessageSize(0, 8), WithRetryPolicy(RetryPolicy{
+		Idempotent: []string{"Arith.Add"},
+		Retryable: func(err error) bool {
+			atomic.AddInt32(&tries, 1)
+			return DefaultRetryable(err)
+		},
+	}))
+	defer retrying.Close()
+	if err = retrying.Call("Arith.Add", &Args{1, 2}, new(Reply)); !errors.Is(err, ErrProtocol) || tries != 1 {
+		t.Error("expected the protocol error not to be retried, got", err, tries)
+	}
+	// and the server's show up as one too
+	plain := New(addr)
+	defer plain.Close()
+	err = plain.Call("Arith.Add", bson.M{"a": 1, "b": 2, "pad": strings.Repeat("x", 64)}, new(Reply))
+	var be *BackendError
+	if !errors.Is(err, ErrProtocol) || !errors.As(err, &be) || be.Code != CodeProtocolError {
+		t.Error("expected a protocol error from the server, got", err)
+	}
+	// nor does it count against the server
+	broken, _ := Dial(addr, WithMaxMessageSize(0, 8), WithCircuitBreaker(BreakerConfig{ConsecutiveFailures: 1}))
+	defer broken.Close()
+	if err = broken.Call("Arith.Add", &Args{1, 2}, new(Reply)); !errors.Is(err, ErrProtocol) {
+		t.Error("expected a protocol error, got", err)
+	}
+	if broken.CircuitState() != CircuitClosed {
+		t.Error("expected the breaker to stay closed, got", broken.CircuitState())
+	}
+	client, _ = Dial(addr, WithMaxMessageSize(0, 16))
+	defer client.Close()
+	if err = client.Call("Arith.Add", &Args{1, 2}, new(Reply)); err != nil {
+		t.Error("Add within the limit:", err)
+	}
+}
+
+// the requests in a fuzzed stream are read until the first error
+func FuzzServerCodec(f *testing.F) {
+	var b bytes.Buffer
+	writeRaw(&b, bson.M{"operation": 1, "method": "Arith.Add", "seq": 1}, &Args{1, 2})
+	f.Add(b.Bytes())
+	f.Add(append(b.Bytes(), b.Bytes()...))
+	f.Add(frame(3))
+	f.Add(frame(0xffffffff))
+	f.Add(frame(5, 0))
+	f.Add(frame(5, 1))
+	f.Add(frame(16, 0))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		codec := NewServerCodecLimits(readOnlyConn{bytes.NewReader(data)}, FrameLimits{256, 256})
+		for {
+			req := new(Request)
+			if err := codec.ReadRequestHeader(req); err != nil {
+				break
+			}
+			if err := codec.ReadRequestBody(new(Args)); brokenStream(err) {
+				break
+			}
+		}
+	})
+}
+
+func FuzzClientCodec(f *testing.F) {
+	var b bytes.Buffer
+	writeRaw(&b, bson.M{"operation": 2, "seq": 1}, &Reply{3})
+	f.Add(b.Bytes())
+	f.Add(frame(0))
+	f.Add(frame(0x80000000))
+	f.Add(frame(5, 0))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		codec := NewClientCodecLimits(readOnlyConn{bytes.NewReader(data)}, FrameLimits{256, 256})
+		for {
+			if err := codec.ReadResponseHeader(new(Response)); err != nil {
+				break
+			}
+			if err := codec.ReadResponseBody(new(Reply)); brokenStream(err) {
+				break
+			}
+		}
+	})
+}
+
+type readOnlyConn struct {
+	io.Reader
+}
+
+func (readOnlyConn) Write(b []byte) (int, error) { return len(b), nil }
+func (readOnlyConn) Close() error                { return nil }
@@ -0,0 +1,264 @@
+// Date: 2026-10-17
+// authenticating calls with credentials carried in the request metadata
+
+package rpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the code of calls the server's Authenticator rejected
+const CodeUnauthenticated = "rpc.Unauthenticated"
+
+// the metadata keys of the built-in credentials
+const (
+	TokenKey     = "authorization"
+	KeyIDKey     = "auth-key"
+	TimestampKey = "auth-timestamp"
+	NonceKey     = "auth-nonce"
+	SignatureKey = "auth-signature"
+)
+
+// checks the credentials of every call before it runs, see
+// Server.Authenticator. The CallInfo of the call is in ctx, with the
+// connection's TLS state. The principal returned is put in
+// CallInfo.Principal, an error rejects the call as Unauthenticated.
+type Authenticator interface {
+	Authenticate(ctx context.Context, req *Request) (principal string, err error)
+}
+
+// authenticate the call ctx belongs to
+func (server *Server) authenticate(ctx context.Context, req *Request) error {
+	if server.Authenticator == nil {
+		return nil
+	}
+	principal, err := server.Authenticator.Authenticate(ctx, req)
+	if err != nil {
+		return &BackendError{CodeUnauthenticated, err.Error()}
+	}
+	if info, ok := CallInfoFromContext(ctx); ok {
+		info.Principal = principal
+	}
+	return nil
+}
+
+var errNoCredentials = errors.New("no credentials")
+var errBadCredentials = errors.New("bad credentials")
+
+// accepts calls carrying one of a fixed set of tokens
+type TokenAuthenticator struct {
+	tokens map[string]string
+}
+
+// tokens maps every accepted token to its principal
+func NewTokenAuthenticator(tokens map[string]string) *TokenAuthenticator {
+	a := &TokenAuthenticator{tokens: make(map[string]string)}
+	for token, principal := range tokens {
+		a.tokens[token] = principal
+	}
+	return a
+}
+
+func (a *TokenAuthenticator) Authenticate(ctx context.Context, req *Request) (string, error) {
+	token := req.Metadata[TokenKey]
+	if token == "" {
+		return "", errNoCredentials
+	}
+	principal, found := "", false
+	// look at every token so the time taken gives nothing away
+	for t, p := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			principal, found = p, true
+		}
+	}
+	if !found {
+		return "", errBadCredentials
+	}
+	return principal, nil
+}
+
+// accepts callers that prove they hold a shared secret. The HMAC covers
+// the key id, the method, a timestamp and a nonce, it authenticates the
+// caller but does not sign the request: the args and the rest of the
+// metadata can be changed on the way, use TLS when they need protecting.
+// A nonce is only accepted once and the timestamp must be within the
+// window, which stops replays.
+type HMACAuthenticator struct {
+	keys   map[string][]byte
+	window time.Duration
+	mu     sync.Mutex
+	nonces map[string]time.Time // when each nonce seen can be forgotten
+	prune  time.Time            // when expired nonces are next dropped
+}
+
+// keys maps every key id to its secret, the key id is the principal. A
+// window of 0 means 5 minutes either side of the server's clock.
+func NewHMACAuthenticator(keys map[string][]byte, window time.Duration) *HMACAuthenticator {
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	a := &HMACAuthenticator{keys: make(map[string][]byte), window: window, nonces: make(map[string]time.Time)}
+	for id, secret := range keys {
+		a.keys[id] = secret
+	}
+	return a
+}
+
+func (a *HMACAuthenticator) Authenticate(ctx context.Context, req *Request) (string, error) {
+	md := req.Metadata
+	id, ts, nonce := md[KeyIDKey], md[TimestampKey], md[NonceKey]
+	if id == "" || ts == "" || nonce == "" || md[SignatureKey] == "" {
+		return "", errNoCredentials
+	}
+	secret, ok := a.keys[id]
+	if !ok {
+		return "", errBadCredentials
+	}
+	sig, err := hex.DecodeString(md[SignatureKey])
+	if err != nil || !hmac.Equal(sig, sign(secret, id, req.Method, ts, nonce)) {
+		return "", errBadCredentials
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", errBadCredentials
+	}
+	now := time.Now()
+	if t := time.Unix(unix, 0); t.Before(now.Add(-a.window)) || t.After(now.Add(a.window)) {
+		return "", errors.New("timestamp out of window")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.After(a.prune) {
+		for n, expires := range a.nonces {
+			if now.After(expires) {
+				delete(a.nonces, n)
+			}
+		}
+		a.prune = now.Add(a.window)
+	}
+	key := id + "\n" + nonce
+	if _, seen := a.nonces[key]; seen {
+		return "", errors.New("replayed request")
+	}
+	// past the window the timestamp check rejects it anyway
+	a.nonces[key] = time.Unix(unix, 0).Add(a.window)
+	return id, nil
+}
+
+func sign(secret []byte, id, method, ts, nonce string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id + "\n" + method + "\n" + ts + "\n" + nonce))
+	return mac.Sum(nil)
+}
+
+// adds credentials to the metadata of a request. It is called every time
+// the request is sent, retries included.
+type Credentials func(ctx context.Context, req *Request) error
+
+// send credentials with every call
+func WithCredentials(creds Credentials) DialOption {
+	return func(c *Client) {
+		c.credentials = creds
+	}
+}
+
+// the credentials a TokenAuthenticator checks
+func TokenCredentials(token string) Credentials {
+	return func(ctx context.Context, req *Request) error {
+		req.Metadata[TokenKey] = token
+		return nil
+	}
+}
+
+// the credentials a HMACAuthenticator checks, they don't cover the args
+func HMACCredentials(id string, secret []byte) Credentials {
+	return func(ctx context.Context, req *Request) error {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return err
+		}
+		ts, nonce := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(b[:])
+		req.Metadata[KeyIDKey] = id
+		req.Metadata[TimestampKey] = ts
+		req.Metadata[NonceKey] = nonce
+		req.Metadata[SignatureKey] = hex.EncodeToString(sign(secret, id, req.Method, ts, nonce))
+		return nil
+	}
+}
+
+// the code of calls the server's ACL rejected
+const CodePermissionDenied = "rpc.PermissionDenied"
+
+// which principals may call which methods. The keys are "Service.Method",
+// "Service.*" or "*", the most specific one that matches a call decides.
+// A principal of "*" lets anyone call, methods no key matches can't be
+// called at all.
+type ACL map[string][]string
+
+// restrict calls to the principals acl allows, nil lifts the restriction.
+// Every key must name a registered service or method.
+func (server *Server) SetACL(acl ACL) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if acl == nil {
+		server.acl = nil
+		return nil
+	}
+	copied := make(ACL, len(acl))
+	for key, principals := range acl {
+		if key != "*" {
+			dot := strings.Index(key, ".")
+			if dot < 0 {
+				return errors.New("rpc: bad acl key " + key)
+			}
+			s := server.serviceMap[key[:dot]]
+			if s == nil {
+				return errors.New("rpc: acl names unknown service " + key)
+			}
+			if name := key[dot+1:]; name != "*" && s.method[name] == nil {
+				return errors.New("rpc: acl names unknown method " + key)
+			}
+		}
+		copied[key] = append([]string(nil), principals...)
+	}
+	server.acl = copied
+	return nil
+}
+
+// check the call against the ACL
+func (server *Server) authorize(info *CallInfo) error {
+	server.mu.Lock()
+	acl := server.acl
+	server.mu.Unlock()
+	if acl == nil {
+		return nil
+	}
+	principals, ok := acl[info.Service+"."+info.Method]
+	if !ok {
+		principals, ok = acl[info.Service+".*"]
+	}
+	if !ok {
+		principals = acl["*"]
+	}
+	for _, p := range principals {
+		if p == "*" || p != "" && p == info.Principal {
+			return nil
+		}
+	}
+	who := info.Principal
+	if who == "" {
+		who = "anonymous"
+	}
+	return &BackendError{CodePermissionDenied, who + " may not call " + info.Service + "." + info.Method}
+}
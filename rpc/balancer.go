@@ -0,0 +1,389 @@
+// Date: 2026-10-17
+// spreading calls over the backends a Resolver finds
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoBackends = errors.New("rpc: no backends")
+
+// finds the addresses of the backends of a service. It is asked again
+// every resolve interval, the set may change between calls.
+type Resolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+// a fixed list of addresses
+type StaticResolver []string
+
+func (r StaticResolver) Resolve(ctx context.Context) ([]string, error) {
+	return append([]string(nil), r...), nil
+}
+
+// looks up the SRV records of _Service._Proto.Name
+type SRVResolver struct {
+	Service string
+	Proto   string
+	Name    string
+}
+
+func (r SRVResolver) Resolve(ctx context.Context) ([]string, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, r.Service, r.Proto, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	return addrs, nil
+}
+
+// how a BalancedClient picks the backend of a call
+type BalancePolicy int
+
+const (
+	RoundRobin       BalancePolicy = iota
+	LeastOutstanding               // the backend with the fewest calls in flight
+	ConsistentHash                 // by the call key, see WithCallKey, round robin without one
+)
+
+// configures a BalancedClient in DialBalanced
+type BalancerOption func(*BalancedClient)
+
+func WithBalancePolicy(p BalancePolicy) BalancerOption {
+	return func(b *BalancedClient) {
+		b.policy = p
+	}
+}
+
+// options for the client of every backend
+func WithBackendOptions(opts ...DialOption) BalancerOption {
+	return func(b *BalancedClient) {
+		b.dialOpts = append(b.dialOpts, opts...)
+	}
+}
+
+// ask the resolver again every d, 30s by default
+func WithResolveInterval(d time.Duration) BalancerOption {
+	return func(b *BalancedClient) {
+		b.resolveInterval = d
+	}
+}
+
+// take a backend out of rotation for d once that many calls in a row
+// failed on it, 5 and 30s by default. Connection errors, calls that ran
+// out of time and calls stopped by the backend's circuit breaker are
+// failures.
+func WithEjection(failures int, d time.Duration) BalancerOption {
+	return func(b *BalancedClient) {
+		b.maxFailures, b.ejectTime = failures, d
+	}
+}
+
+// the key a ConsistentHash client sends the call by, calls with the
+// same key go to the same backend while it is up
+func WithCallKey(key string) CallOption {
+	return func(o *callOptions) {
+		o.key = key
+	}
+}
+
+type backend struct {
+	addr         string
+	client       *Client
+	inflight     int
+	failures     int // failed calls in a row
+	ejectedUntil time.Time
+	removed      bool // the resolver dropped it, closed once idle
+}
+
+// the points a backend has on the hash ring
+const ringReplicas = 64
+
+// a client for a set of backends, every call goes to one of them
+type BalancedClient struct {
+	resolver        Resolver
+	policy          BalancePolicy
+	dialOpts        []DialOption
+	resolveInterval time.Duration
+	maxFailures     int
+	ejectTime       time.Duration
+
+	mu       sync.Mutex // protects the fields below and those of backend
+	backends []*backend
+	ring     []uint32
+	owners   []*backend // of the ring points
+	next     int
+	closed   bool
+
+	updateMu sync.Mutex // one update at a time
+	closeCh  chan struct{}
+}
+
+// make a client for the backends r finds, they are dialed with the
+// backend options. Fails if r fails the first time.
+func DialBalanced(r Resolver, opts ...BalancerOption) (*BalancedClient, error) {
+	b := &BalancedClient{
+		resolver:        r,
+		resolveInterval: 30 * time.Second,
+		maxFailures:     5,
+		ejectTime:       30 * time.Second,
+		closeCh:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	addrs, err := r.Resolve(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	b.update(addrs)
+	go b.watch()
+	return b, nil
+}
+
+// resolve every interval until Close
+func (b *BalancedClient) watch() {
+	t := time.NewTicker(b.resolveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.closeCh:
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), b.resolveInterval)
+		addrs, err := b.resolver.Resolve(ctx)
+		cancel()
+		if err != nil {
+			// keep the backends we have
+			log.Println("rpc: resolve:", err)
+			continue
+		}
+		b.update(addrs)
+	}
+}
+
+// make addrs the backends, the ones no longer there are closed once
+// their calls are done
+func (b *BalancedClient) update(addrs []string) {
+	b.updateMu.Lock()
+	defer b.updateMu.Unlock()
+
+	b.mu.Lock()
+	current := make(map[string]*backend)
+	for _, be := range b.backends {
+		current[be.addr] = be
+	}
+	b.mu.Unlock()
+
+	var backends []*backend
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if be := current[addr]; be != nil {
+			backends = append(backends, be)
+			continue
+		}
+		client, err := Dial(addr, b.dialOpts...)
+		if err != nil {
+			log.Println("rpc: backend", addr+":", err)
+			continue
+		}
+		backends = append(backends, &backend{addr: addr, client: client})
+	}
+
+	var idle []*Client
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		for _, be := range backends {
+			if current[be.addr] == nil {
+				be.client.Close()
+			}
+		}
+		return
+	}
+	for addr, be := range current {
+		if !seen[addr] {
+			be.removed = true
+			if be.inflight == 0 {
+				idle = append(idle, be.client)
+			}
+		}
+	}
+	b.backends = backends
+	b.ring, b.owners = b.ring[:0], b.owners[:0]
+	for _, be := range backends {
+		for i := 0; i < ringReplicas; i++ {
+			b.ring = append(b.ring, crc32.ChecksumIEEE([]byte(be.addr+"#"+strconv.Itoa(i))))
+			b.owners = append(b.owners, be)
+		}
+	}
+	sort.Sort(ringSorter{b})
+	b.mu.Unlock()
+
+	for _, c := range idle {
+		c.Close()
+	}
+}
+
+type ringSorter struct{ b *BalancedClient }
+
+func (s ringSorter) Len() int           { return len(s.b.ring) }
+func (s ringSorter) Less(i, j int) bool { return s.b.ring[i] < s.b.ring[j] }
+func (s ringSorter) Swap(i, j int) {
+	s.b.ring[i], s.b.ring[j] = s.b.ring[j], s.b.ring[i]
+	s.b.owners[i], s.b.owners[j] = s.b.owners[j], s.b.owners[i]
+}
+
+// pick the backend of a call and count it in flight
+func (b *BalancedClient) pick(key string) (*backend, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrShutdown
+	}
+	if len(b.backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	now := time.Now()
+	up := func(be *backend) bool { return !be.ejectedUntil.After(now) }
+	healthy := make([]*backend, 0, len(b.backends))
+	for _, be := range b.backends {
+		if up(be) {
+			healthy = append(healthy, be)
+		}
+	}
+	if len(healthy) == 0 {
+		// better to try one than to fail every call
+		healthy = b.backends
+		up = func(*backend) bool { return true }
+	}
+
+	var best *backend
+	switch {
+	case b.policy == ConsistentHash && key != "":
+		h := crc32.ChecksumIEEE([]byte(key))
+		i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= h })
+		for n := 0; n < len(b.ring); n++ {
+			if be := b.owners[(i+n)%len(b.ring)]; up(be) {
+				best = be
+				break
+			}
+		}
+	case b.policy == LeastOutstanding:
+		// start where round robin is, to spread ties
+		for n := range healthy {
+			be := healthy[(b.next+n)%len(healthy)]
+			if best == nil || be.inflight < best.inflight {
+				best = be
+			}
+		}
+		b.next++
+	default:
+		best = healthy[b.next%len(healthy)]
+		b.next++
+	}
+	best.inflight++
+	return best, nil
+}
+
+// a call on be is done, eject it when the failures add up
+func (b *BalancedClient) release(be *backend, err error) {
+	b.mu.Lock()
+	be.inflight--
+	if err != nil && (isFailure(err) || errors.Is(err, ErrCircuitOpen)) {
+		if be.failures++; be.failures >= b.maxFailures {
+			be.failures = 0
+			be.ejectedUntil = time.Now().Add(b.ejectTime)
+			log.Println("rpc: ejecting backend", be.addr+":", err)
+		}
+	} else {
+		be.failures = 0
+	}
+	idle := be.removed && be.inflight == 0
+	b.mu.Unlock()
+	if idle {
+		be.client.Close()
+	}
+}
+
+func (b *BalancedClient) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	return b.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// call the service method on one of the backends
+func (b *BalancedClient) CallContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}, opts ...CallOption) error {
+	o := new(callOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	be, err := b.pick(o.key)
+	if err != nil {
+		return err
+	}
+	err = be.client.CallContext(ctx, serviceMethod, args, reply, opts...)
+	b.release(be, err)
+	return err
+}
+
+// invoke the service method asynchronously on one of the backends, like
+// Client.Go but a goroutine waits for every call
+func (b *BalancedClient) Go(serviceMethod string, args interface{}, reply interface{}, done chan *Call, opts ...CallOption) *Call {
+	if done == nil {
+		done = make(chan *Call, 10) // buffered.
+	} else if cap(done) == 0 {
+		log.Panic("rpc: done channel is unbuffered")
+	}
+	call := &Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	go func() {
+		call.Error = b.CallContext(context.Background(), serviceMethod, args, reply, opts...)
+		call.done()
+	}()
+	return call
+}
+
+// the addresses of the backends in use
+func (b *BalancedClient) Backends() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrs := make([]string, 0, len(b.backends))
+	for _, be := range b.backends {
+		addrs = append(addrs, be.addr)
+	}
+	return addrs
+}
+
+// close the clients of every backend, calls in flight fail
+func (b *BalancedClient) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrShutdown
+	}
+	b.closed = true
+	backends := b.backends
+	b.backends = nil
+	close(b.closeCh)
+	b.mu.Unlock()
+	for _, be := range backends {
+		be.client.Close()
+	}
+	return nil
+}
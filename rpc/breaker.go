@@ -0,0 +1,188 @@
+// Date: 2026-10-17
+// failing fast while the server of a client is down, see WithCircuitBreaker
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// returned without trying while the circuit breaker is open
+var ErrCircuitOpen = errors.New("rpc: circuit breaker is open")
+
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // calls go through
+	CircuitOpen                         // calls fail with ErrCircuitOpen
+	CircuitHalfOpen                     // a few trial calls go through
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// when a circuit breaker opens and closes again. It opens on a run of
+// failures or on a high error rate, and after OpenTimeout lets trial
+// calls through. It closes once they all succeed.
+type BreakerConfig struct {
+	ConsecutiveFailures int           // open after this many failures in a row, 0 means 5
+	ErrorRate           float64       // open when this fraction of the calls fail, 0 means never
+	MinCalls            int           // calls in a window before ErrorRate counts, 0 means 20
+	Window              time.Duration // the error rate is measured over this, 0 means 10s
+	OpenTimeout         time.Duration // wait this long before the trial calls, 0 means 5s
+	HalfOpenCalls       int           // trial calls, 0 means 1
+	// whether an error counts as a failure, nil means connection errors
+	// and calls that ran out of time, but not calls over a server limit
+	// or the client's own errors
+	IsFailure func(error) bool
+	// called on every transition, endpoint is the address dialed
+	OnStateChange func(endpoint string, from, to CircuitState)
+}
+
+// stop calling the server for a while once it looks down
+func WithCircuitBreaker(cfg BreakerConfig) DialOption {
+	return func(c *Client) {
+		if cfg.ConsecutiveFailures <= 0 {
+			cfg.ConsecutiveFailures = 5
+		}
+		if cfg.MinCalls <= 0 {
+			cfg.MinCalls = 20
+		}
+		if cfg.Window <= 0 {
+			cfg.Window = 10 * time.Second
+		}
+		if cfg.OpenTimeout <= 0 {
+			cfg.OpenTimeout = 5 * time.Second
+		}
+		if cfg.HalfOpenCalls <= 0 {
+			cfg.HalfOpenCalls = 1
+		}
+		if cfg.IsFailure == nil {
+			cfg.IsFailure = isFailure
+		}
+		c.breaker = &breaker{cfg: cfg}
+	}
+}
+
+// connection errors and calls that ran out of time. Calls the server
+// turned away for being over a limit are not failures, the server is up,
+// nor are the client's own errors such as a reply over its frame limit.
+func isFailure(err error) bool {
+	return connError(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+type breaker struct {
+	cfg      BreakerConfig
+	mu       sync.Mutex
+	state    CircuitState
+	openedAt time.Time
+	failures int // in a row
+	// the current error rate window
+	windowStart time.Time
+	calls       int
+	failed      int
+	// half open
+	trials    int // let through
+	succeeded int
+	// counts the transitions, a call is only counted in the state it was
+	// let through in
+	gen uint64
+}
+
+// whether a call may go through, false means fail with ErrCircuitOpen.
+// gen is handed back to done.
+func (b *breaker) allow(endpoint string) (gen uint64, ok bool) {
+	b.mu.Lock()
+	from := b.state
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.cfg.OpenTimeout {
+		b.state, b.trials, b.succeeded = CircuitHalfOpen, 0, 0
+		b.gen++
+	}
+	ok = b.state == CircuitClosed
+	if b.state == CircuitHalfOpen && b.trials < b.cfg.HalfOpenCalls {
+		b.trials++
+		ok = true
+	}
+	to, gen := b.state, b.gen
+	b.mu.Unlock()
+	b.notify(endpoint, from, to)
+	return gen, ok
+}
+
+// record how a call that was allowed went. Calls let through before the
+// last transition and calls their caller cancelled say nothing about the
+// server, a cancelled trial makes room for another.
+func (b *breaker) done(endpoint string, gen uint64, err error) {
+	failed := err != nil && b.cfg.IsFailure(err)
+	cancelled := !failed && errors.Is(err, context.Canceled)
+	b.mu.Lock()
+	from := b.state
+	switch {
+	case gen != b.gen:
+	case cancelled:
+		if b.state == CircuitHalfOpen {
+			b.trials--
+		}
+	case b.state == CircuitHalfOpen:
+		if failed {
+			b.open()
+		} else if b.succeeded++; b.succeeded >= b.cfg.HalfOpenCalls {
+			b.state, b.failures = CircuitClosed, 0
+			b.windowStart, b.calls, b.failed = time.Now(), 0, 0
+			b.gen++
+		}
+	case b.state == CircuitClosed:
+		now := time.Now()
+		if now.Sub(b.windowStart) > b.cfg.Window {
+			b.windowStart, b.calls, b.failed = now, 0, 0
+		}
+		b.calls++
+		if failed {
+			b.failed++
+			b.failures++
+		} else {
+			b.failures = 0
+		}
+		if b.failures >= b.cfg.ConsecutiveFailures ||
+			b.cfg.ErrorRate > 0 && b.calls >= b.cfg.MinCalls && float64(b.failed) >= b.cfg.ErrorRate*float64(b.calls) {
+			b.open()
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(endpoint, from, to)
+}
+
+// b.mu is held
+func (b *breaker) open() {
+	b.state, b.openedAt, b.failures = CircuitOpen, time.Now(), 0
+	b.gen++
+}
+
+func (b *breaker) notify(endpoint string, from, to CircuitState) {
+	if to != from && b.cfg.OnStateChange != nil {
+		b.cfg.OnStateChange(endpoint, from, to)
+	}
+}
+
+// the state of the circuit breaker, always closed without one
+func (c *Client) CircuitState() CircuitState {
+	if c.breaker == nil {
+		return CircuitClosed
+	}
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+	return c.breaker.state
+}
@@ -4,227 +4,1016 @@
 package rpc
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
 	"net"
 	"sync"
 	"time"
-    "oocrpc/bson"
 )
 
 // timeout
 const DefaultTimeout = time.Duration(10000) * time.Millisecond
 
+// connections a client spreads its calls over
+const DefaultPoolSize = 1
+
 // connection pool number
+//
+// Deprecated: a client no longer pools a connection per call, it keeps
+// DefaultPoolSize connections, see WithPoolSize.
 const DefaultConnectionPool = 10
 
+var ErrShutdown = errors.New("rpc: client is shut down")
+
+// the client multiplexes calls over a few connections, replies are
+// matched to calls by seq
 type Client struct {
-	addr     net.Addr
-	mutex    sync.Mutex
-	Timeout  time.Duration
-	freeconn []*conn
+	network     string
+	target      string
+	addr        net.Addr // nil when the target is resolved on every dial
+	reResolve   bool
+	tlsConfig   *tls.Config
+	poolSize    int
+	dialTimeout time.Duration
+	mutex       sync.Mutex
+	// calls whose context has no deadline give up after Timeout,
+	// zero means DefaultTimeout and a negative value means never
+	Timeout     time.Duration
+	newCodec    func(io.ReadWriteCloser) ClientCodec
+	frameLimits FrameLimits // for the default codec, see WithMaxMessageSize
+	conns       []*conn
+	dialMutex   sync.Mutex
+	closed      bool
+
+	maxStreams  int           // calls in flight per connection, 0 means no limit
+	idleTimeout time.Duration // close connections idle for longer
+	maxLifetime time.Duration // retire connections older than this
+	waiters     []chan struct{}
+	stats       PoolStats // the counters, the rest is filled in by Stats
+	cleanerCh   chan struct{}
+
+	interceptors []ClientInterceptor
+	invoke       Invoker // c.call wrapped in the interceptors
+
+	retry       *RetryPolicy    // nil means calls are not retried
+	credentials Credentials     // added to every request
+	breaker     *breaker        // nil means no circuit breaker
+	idempotent  map[string]bool // methods safe to retry, protected by mutex
 }
 
-type conn struct {
-	cn net.Conn
-	rw *bufio.ReadWriter
-	c  *Client
+// an active call, see Client.Go
+type Call struct {
+	ServiceMethod string
+	Args          interface{}
+	Reply         interface{}
+	Error         error
+	Done          chan *Call // receives the call once it is complete
+	Metadata      Metadata   // sent back by the server
+	seq           uint64
+	timer         *time.Timer // fails a Go call once the Timeout passes
+	sent          bool        // the request may have reached the server
+	finish        func()      // called instead of sending on Done, see goAttempt
 }
 
-func (cn *conn) WriteRequest(req *clientRequest, body interface{}) (err error) {
-	rw := cn.rw.Writer
-	// write request header
-	bys, err := bson.Marshal(req)
-	if err != nil {
-		log.Println("marshal request header error, ", err.Error())
-		return
+func (call *Call) done() {
+	if call.timer != nil {
+		call.timer.Stop()
 	}
-	_, err = rw.Write(bys)
-	if err != nil {
-		log.Println("write request header error, ", err.Error())
-		return
-	}
-	// write request body
-    bys, err = bson.Marshal(body)
-	if err != nil {
-		log.Println("marshal request body error, ", err.Error())
+	if call.finish != nil {
+		call.finish()
 		return
 	}
-	_, err = rw.Write(bys)
-	if err != nil {
-		log.Println("write request body error, ", err.Error())
+	select {
+	case call.Done <- call:
+	default:
+		// we don't want to block here, it is the caller's
+		// responsibility to make sure the channel has enough buffer space
+		log.Println("rpc: discarding Call reply due to insufficient Done chan capacity")
 	}
-	if err = rw.Flush(); err != nil {
-		log.Println("write request error, ", err.Error())
+}
+
+type conn struct {
+	codec   ClientCodec
+	c       *Client
+	sending sync.Mutex // serializes requests on the wire
+	mutex   sync.Mutex // protects seq, pending and err
+	seq     uint64
+	pending map[uint64]*Call
+	err     error // set once the connection is broken
+	// a quarantined connection takes no new calls and is closed
+	// as soon as its pending calls are done
+	quarantined bool
+	createdAt   time.Time
+	idleSince   time.Time // when pending last became empty
+}
+
+// read responses and hand them to the waiting calls
+func (cn *conn) input() {
+	var err error
+	for err == nil {
+		res := Response{}
+		if err = cn.codec.ReadResponseHeader(&res); err != nil {
+			break
+		}
+		if res.Operation == 4 {
+			// the server is going away, let the pending calls finish
+			err = cn.codec.ReadResponseBody(nil)
+			if cn.retire() && err == nil {
+				err = errQuarantined
+			}
+			continue
+		}
+		call, drained := cn.take(res.Seq)
+		if call == nil {
+			// nobody is waiting, just discard the body
+			err = cn.codec.ReadResponseBody(nil)
+			continue
+		}
+		call.Metadata = res.Metadata
+		if res.Operation == 3 {
+			err = cn.codec.ReadResponseBody(nil)
+			call.Error = res.err()
+		} else if berr := cn.codec.ReadResponseBody(call.Reply); berr != nil {
+			// a broken stream is caught by the next header read, a
+			// frame that broke the limits is not
+			call.Error = berr
+			if errors.Is(berr, ErrProtocol) {
+				err = berr
+			}
+		}
+		if err != nil {
+			call.Error = err
+		}
+		call.done()
+		if drained && err == nil {
+			err = errQuarantined
+		}
 	}
-	return
+	cn.fail(err)
 }
 
-func (cn *conn) ReadResponse(res *clientResponse, reply interface{}) (err error) {
-	if err = cn.ReadResponseHeader(res); err != nil {
-		return
+var errQuarantined = errors.New("rpc: connection quarantined")
+
+// the request never left the client, it is safe to send it again
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string { return e.err.Error() }
+func (e *notSentError) Unwrap() error { return e.err }
+
+// take the call off the pending list, drained reports whether a
+// quarantined connection has nothing left in flight
+func (cn *conn) take(seq uint64) (call *Call, drained bool) {
+	cn.mutex.Lock()
+	call = cn.pending[seq]
+	delete(cn.pending, seq)
+	if len(cn.pending) == 0 {
+		cn.idleSince = time.Now()
 	}
-	if res.Operation == 3 {
-		cn.ReadResponseBody(&struct{}{})
-		return errors.New(res.Error)
+	drained = cn.quarantined && len(cn.pending) == 0
+	cn.mutex.Unlock()
+	if call != nil {
+		cn.c.signal()
 	}
-	err = cn.ReadResponseBody(reply)
 	return
 }
 
-func (cn *conn) ReadResponseHeader(res *clientResponse) (err error) {
-	msgheader := make([]byte, 4)
-	n, err := cn.rw.Read(msgheader)
-	if n != 4 {
-		return io.ErrUnexpectedEOF
+// send the request, the reply is delivered by input. With expire set
+// the call is failed once the deadline passes. A non-nil error means the
+// call was not sent and is not pending.
+func (cn *conn) send(req *Request, call *Call, deadline time.Time, expire bool) error {
+	cn.sending.Lock()
+	defer cn.sending.Unlock()
+
+	cn.mutex.Lock()
+	if cn.err != nil {
+		cn.mutex.Unlock()
+		return &notSentError{cn.err}
 	}
-	if err != nil {
-		res = nil
-		if err == io.EOF {
-			return errors.New("rpc: client cannot read requestHeader" + err.Error())
-		}
-		err = errors.New("rpc: client cannot read requestHeader " + err.Error())
-		return
+	cn.seq++
+	req.Seq = cn.seq
+	call.seq = req.Seq
+	cn.pending[call.seq] = call
+	// set under the lock, whoever takes the call off pending reads it
+	call.sent = true
+	if expire && !deadline.IsZero() {
+		call.timer = time.AfterFunc(time.Until(deadline), func() {
+			cn.abandon(call, context.DeadlineExceeded)
+		})
 	}
-	length := binary.LittleEndian.Uint32(msgheader)
-	b := make([]byte, length)
-	binary.LittleEndian.PutUint32(b, length)
-	n, err = io.ReadFull(cn.rw.Reader, b[4:])
-	if err != nil {
-		if err == io.EOF {
-			return io.ErrUnexpectedEOF
+	cn.mutex.Unlock()
+
+	if d, ok := cn.codec.(interface{ SetWriteDeadline(time.Time) error }); ok && !deadline.IsZero() {
+		d.SetWriteDeadline(deadline)
+		defer d.SetWriteDeadline(time.Time{})
+	}
+	if err := cn.codec.WriteRequest(req, call.Args); err != nil {
+		taken, _ := cn.take(call.seq)
+		own := taken == call
+		// a half written request leaves the stream out of sync
+		cn.fail(err)
+		if !own {
+			// the timer got to it first
+			return nil
+		}
+		if call.timer != nil {
+			call.timer.Stop()
 		}
+		return err
+	}
+	return nil
+}
+
+// give up on a call that is still pending and complete it with err. The
+// reply may still arrive and would be dropped, but a server that misses a
+// deadline is suspect, so the connection is taken out of service and
+// closed once it drains. False if the call was no longer pending.
+func (cn *conn) abandon(call *Call, err error) bool {
+	if taken, _ := cn.take(call.seq); taken != call {
+		return false
+	}
+
+	call.Error = err
+	call.done()
+	if cn.retire() {
+		cn.fail(errQuarantined)
+	}
+	return true
+}
+
+// take the connection out of service, true if no call is pending on it
+func (cn *conn) retire() bool {
+	cn.mutex.Lock()
+	cn.quarantined = true
+	drained := len(cn.pending) == 0
+	cn.mutex.Unlock()
+
+	cn.c.removeConn(cn)
+	return drained
+}
+
+// mark the connection broken, close it and fail every pending call
+func (cn *conn) fail(err error) {
+	cn.mutex.Lock()
+	if cn.err != nil {
+		cn.mutex.Unlock()
 		return
 	}
-	if n != int(length-4) {
-		return io.ErrUnexpectedEOF
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-	err = bson.Unmarshal(b, res)
-	return
+	cn.err = err
+	pending := cn.pending
+	cn.pending = nil
+	cn.mutex.Unlock()
+
+	cn.codec.Close()
+	cn.c.removeConn(cn)
+
+	for _, call := range pending {
+		call.Error = err
+		call.done()
+	}
+	cn.c.signal()
+}
+
+// an error returned by a method on the server, one that carries no code
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
 }
 
-func (cn *conn) ReadResponseBody(reply interface{}) (err error) {
-	msgbody := make([]byte, 4)
-	n, err := cn.rw.Read(msgbody)
-	if n != 4 {
-		return io.ErrUnexpectedEOF
+// the error of a failed call, a *BackendError when the server sent a code
+// or a *RetryAfterError when it also said when to call again
+func (res *Response) err() error {
+	if res.Code != "" && res.RetryAfter > 0 {
+		return &RetryAfterError{BackendError{res.Code, res.Detail}, time.Duration(res.RetryAfter) * time.Millisecond}
 	}
-	if err != nil {
-		if err == io.EOF {
-			return io.ErrUnexpectedEOF
-		}
-		return
+	if res.Code != "" {
+		return &BackendError{Code: res.Code, Detail: res.Detail}
 	}
-	length := binary.LittleEndian.Uint32(msgbody)
-	b := make([]byte, length)
-	binary.LittleEndian.PutUint32(b, length)
-	n, err = io.ReadFull(cn.rw.Reader, b[4:])
-	if err != nil {
-		if err == io.EOF {
-			return io.ErrUnexpectedEOF
+	return ServerError(res.Error)
+}
+
+// configures a client in Dial
+type DialOption func(*Client)
+
+// spread calls over up to n connections, a new one is only opened when
+// every open connection has calls in flight
+func WithPoolSize(n int) DialOption {
+	return func(c *Client) {
+		c.poolSize = n
+	}
+}
+
+// give up connecting after d
+func WithDialTimeout(d time.Duration) DialOption {
+	return func(c *Client) {
+		c.dialTimeout = d
+	}
+}
+
+// set the Timeout of calls without a deadline
+func WithCallTimeout(d time.Duration) DialOption {
+	return func(c *Client) {
+		c.Timeout = d
+	}
+}
+
+// dial over network, "tcp" by default, "unix" for unix sockets
+func WithNetwork(network string) DialOption {
+	return func(c *Client) {
+		c.network = network
+	}
+}
+
+// speak TLS, with Certificates set the client presents one to servers
+// that ask. An empty ServerName is taken from the address passed to Dial.
+func WithTLSConfig(config *tls.Config) DialOption {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// resolve the address every time a connection is made instead of once
+// in Dial, so address changes are picked up and Dial never fails on a
+// resolver error
+func WithReResolve() DialOption {
+	return func(c *Client) {
+		c.reResolve = true
+	}
+}
+
+// allow at most n calls in flight per connection. Once every connection
+// of a full pool is at the limit, calls wait in line for a free slot.
+func WithMaxStreams(n int) DialOption {
+	return func(c *Client) {
+		c.maxStreams = n
+	}
+}
+
+// close connections that had no call in flight for d
+func WithIdleTimeout(d time.Duration) DialOption {
+	return func(c *Client) {
+		c.idleTimeout = d
+	}
+}
+
+// stop using connections after d, they are closed once drained
+func WithMaxLifetime(d time.Duration) DialOption {
+	return func(c *Client) {
+		c.maxLifetime = d
+	}
+}
+
+// speak to the server through the codec made by f for each connection,
+// NewClientCodec by default
+func WithCodec(f func(io.ReadWriteCloser) ClientCodec) DialOption {
+	return func(c *Client) {
+		c.newCodec = f
+	}
+}
+
+// read responses with headers of up to header bytes and bodies of up to
+// body bytes, 0 means DefaultMaxHeaderSize and DefaultMaxBodySize. A
+// larger one closes the connection. It has no effect with WithCodec.
+func WithMaxMessageSize(header, body int) DialOption {
+	return func(c *Client) {
+		c.frameLimits = FrameLimits{header, body}
+	}
+}
+
+// sends the request and waits for the reply, or runs the rest of the
+// interceptor chain
+type Invoker func(ctx context.Context, req *Request, args, reply interface{}) error
+
+// wraps every call. It may change the outgoing request header, observe
+// the latency and error of invoke, and invoke the call again.
+type ClientInterceptor func(ctx context.Context, req *Request, args, reply interface{}, invoke Invoker) error
+
+// wrap calls in interceptors, the first one is the outermost
+func WithInterceptors(interceptors ...ClientInterceptor) DialOption {
+	return func(c *Client) {
+		c.interceptors = append(c.interceptors, interceptors...)
+	}
+}
+
+func newClient(c *Client, opts []DialOption) *Client {
+	c.poolSize = DefaultPoolSize
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.newCodec == nil {
+		limits := c.frameLimits
+		c.newCodec = func(conn io.ReadWriteCloser) ClientCodec {
+			return NewClientCodecLimits(conn, limits)
 		}
-		return
 	}
-	if n != int(length-4) {
-		return io.ErrUnexpectedEOF
+	if c.poolSize < 1 {
+		c.poolSize = 1
 	}
-    if err = bson.Unmarshal(b,reply); err != nil {
-        return
-    }
-	return
+	if c.idleTimeout > 0 || c.maxLifetime > 0 {
+		c.cleanerCh = make(chan struct{})
+		go c.cleaner()
+	}
+	c.invoke = c.call
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := c.interceptors[i], c.invoke
+		c.invoke = func(ctx context.Context, req *Request, args, reply interface{}) error {
+			return interceptor(ctx, req, args, reply, next)
+		}
+	}
+	return c
 }
 
-type clientRequest struct {
-	Operation uint8
-	Method    string
+// make a client for the server at addr. Connections are made when the
+// first call needs one.
+func Dial(addr string, opts ...DialOption) (*Client, error) {
+	c := newClient(&Client{network: "tcp", target: addr}, opts)
+	// with WithReResolve only the network is checked here
+	var err error
+	switch c.network {
+	case "tcp", "tcp4", "tcp6":
+		if !c.reResolve {
+			c.addr, err = net.ResolveTCPAddr(c.network, addr)
+		}
+	case "unix", "unixpacket":
+		if !c.reResolve {
+			c.addr, err = net.ResolveUnixAddr(c.network, addr)
+		}
+	default:
+		err = errors.New("rpc: unsupported network " + c.network)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
-type clientResponse struct {
-	Operation uint8
-	Error     string
+// make a client that sends every call through codec. Nothing is dialed,
+// once the codec fails calls return ErrShutdown.
+func NewClientWithCodec(codec ClientCodec, opts ...DialOption) *Client {
+	c := newClient(&Client{}, opts)
+	c.network = ""
+	c.conns = []*conn{c.newConn(codec)}
+	return c
 }
 
+// like Dial but panics when the address can't be resolved
 func New(server string) *Client {
-	addr, err := net.ResolveTCPAddr("tcp", server)
+	c, err := Dial(server)
 	if err != nil {
 		panic(err)
 	}
-	return &Client{addr: addr, freeconn: make([]*conn, 0, DefaultConnectionPool)}
+	return c
 }
 
 func (c *Client) dial() (net.Conn, error) {
-	cn, err := net.Dial(c.addr.Network(), c.addr.String())
-	if err != nil {
-		return nil, err
+	if c.network == "" {
+		// made by NewClientWithCodec, there is nothing to dial
+		return nil, ErrShutdown
 	}
-	return cn, nil
+	address := c.target
+	if c.addr != nil {
+		address = c.addr.String()
+	}
+	d := net.Dialer{Timeout: c.dialTimeout}
+	if c.tlsConfig == nil {
+		return d.Dial(c.network, address)
+	}
+	config := c.tlsConfig
+	if config.ServerName == "" {
+		// the address may be resolved already, verify the name we were given
+		if host, _, err := net.SplitHostPort(c.target); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	td := tls.Dialer{NetDialer: &d, Config: config}
+	return td.Dial(c.network, address)
+}
+
+// the number of calls in flight on cn
+func (cn *conn) load() int {
+	cn.mutex.Lock()
+	defer cn.mutex.Unlock()
+	return len(cn.pending)
 }
 
-func (c *Client) getConn() (*conn, error) {
-	cn, ok := c.getFreeConn()
-	if ok {
-		return cn, nil
+// the least loaded connection that can take another call, and whether
+// it should be used rather than dialing a new one. With neither, full
+// reports that the pool can't grow.
+func (c *Client) pickConn() (best *conn, ok bool, full bool, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil, false, false, ErrShutdown
+	}
+	bestLoad := 0
+	for _, cn := range c.conns {
+		load := cn.load()
+		if c.maxStreams > 0 && load >= c.maxStreams {
+			continue
+		}
+		if best == nil || load < bestLoad {
+			best, bestLoad = cn, load
+		}
+	}
+	full = len(c.conns) >= c.poolSize
+	return best, best != nil && (bestLoad == 0 || full), full, nil
+}
+
+// return the least loaded connection, dial a new one while the pool is
+// not full and every connection is busy. When every connection is at
+// the stream limit wait in line until ctx is done.
+func (c *Client) getConn(ctx context.Context) (*conn, error) {
+	var waitStart time.Time
+	for {
+		best, ok, full, err := c.pickConn()
+		if ok || err != nil {
+			c.waited(waitStart)
+			return best, err
+		}
+		if best == nil && full {
+			if waitStart.IsZero() {
+				waitStart = time.Now()
+			}
+			if err := c.wait(ctx); err != nil {
+				c.waited(waitStart)
+				return nil, err
+			}
+			continue
+		}
+		if cn, err := c.dialConn(); cn != nil || err != nil {
+			c.waited(waitStart)
+			return cn, err
+		}
+	}
+}
+
+// dial a new connection for the pool, nil if it filled up meanwhile
+func (c *Client) dialConn() (*conn, error) {
+	// one dial at a time, others may be served by it
+	c.dialMutex.Lock()
+	defer c.dialMutex.Unlock()
+	best, ok, full, err := c.pickConn()
+	if ok || err != nil || full {
+		return best, err
 	}
 
 	nc, err := c.dial()
 	if err != nil {
+		if best != nil {
+			// a busy connection beats none at all
+			return best, nil
+		}
 		return nil, err
 	}
 
-	return &conn{
-		cn: nc,
-		rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
-		c:  c,
-	}, nil
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		nc.Close()
+		return nil, ErrShutdown
+	}
+	cn := c.newConn(c.newCodec(nc))
+	c.conns = append(c.conns, cn)
+	return cn, nil
+}
+
+func (c *Client) newConn(codec ClientCodec) *conn {
+	now := time.Now()
+	cn := &conn{
+		codec:     codec,
+		c:         c,
+		pending:   make(map[uint64]*Call),
+		createdAt: now,
+		idleSince: now,
+	}
+	go cn.input()
+	return cn
+}
+
+// wait for a stream to be freed
+func (c *Client) wait(ctx context.Context) error {
+	ch := make(chan struct{})
+	c.mutex.Lock()
+	c.waiters = append(c.waiters, ch)
+	c.mutex.Unlock()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		c.mutex.Lock()
+		woken := true
+		for i, w := range c.waiters {
+			if w == ch {
+				c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+				woken = false
+				break
+			}
+		}
+		c.mutex.Unlock()
+		if woken {
+			// we were handed a free stream, pass it on to the next in line
+			c.signal()
+		}
+		return ctx.Err()
+	}
 }
 
-func (c *Client) getFreeConn() (*conn, bool) {
+// wake the first waiter, a stream may have been freed
+func (c *Client) signal() {
+	if c.maxStreams <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	if len(c.waiters) > 0 {
+		close(c.waiters[0])
+		c.waiters = c.waiters[1:]
+	}
+	c.mutex.Unlock()
+}
+
+func (c *Client) waited(start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	c.mutex.Lock()
+	c.stats.WaitCount++
+	c.stats.WaitDuration += time.Since(start)
+	c.mutex.Unlock()
+}
+
+// take cn out of the pool, making room for a waiter to dial
+func (c *Client) removeConn(cn *conn) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	if len(c.freeconn) == 0 {
-		return nil, false
+	for i, pc := range c.conns {
+		if pc == cn {
+			c.conns = append(c.conns[:i], c.conns[i+1:]...)
+			if len(c.waiters) > 0 {
+				close(c.waiters[0])
+				c.waiters = c.waiters[1:]
+			}
+			return
+		}
+	}
+}
+
+// close idle connections and retire old ones
+func (c *Client) cleaner() {
+	interval := c.idleTimeout
+	if interval <= 0 || (c.maxLifetime > 0 && c.maxLifetime < interval) {
+		interval = c.maxLifetime
+	}
+	if interval /= 2; interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.cleanerCh:
+			return
+		case <-ticker.C:
+		}
+
+		// the connections are taken out of the pool and, when nothing is
+		// pending, closed for calls before the locks are let go, so no
+		// call is sent on one that is about to be closed
+		var drained []*conn
+		now := time.Now()
+		c.mutex.Lock()
+		conns := make([]*conn, 0, len(c.conns))
+		for _, cn := range c.conns {
+			cn.mutex.Lock()
+			var err error
+			if c.maxLifetime > 0 && now.Sub(cn.createdAt) > c.maxLifetime {
+				// the pending calls finish first, input closes it then
+				cn.quarantined = true
+				err = errQuarantined
+				c.stats.MaxLifetimeClosed++
+			} else if c.idleTimeout > 0 && len(cn.pending) == 0 && now.Sub(cn.idleSince) > c.idleTimeout {
+				err = errIdle
+				c.stats.MaxIdleClosed++
+			}
+			if err == nil {
+				conns = append(conns, cn)
+			} else if len(cn.pending) == 0 && cn.err == nil {
+				cn.err = err
+				drained = append(drained, cn)
+			}
+			cn.mutex.Unlock()
+			if err != nil && len(c.waiters) > 0 {
+				// room to dial another
+				close(c.waiters[0])
+				c.waiters = c.waiters[1:]
+			}
+		}
+		c.conns = conns
+		c.mutex.Unlock()
+
+		for _, cn := range drained {
+			cn.codec.Close()
+		}
 	}
-	cn := c.freeconn[len(c.freeconn)-1]
-	c.freeconn = c.freeconn[:len(c.freeconn)-1]
-	return cn, true
 }
 
-func (c *Client) release(cn *conn) {
+var errIdle = errors.New("rpc: connection closed after idle timeout")
+
+// statistics of a client's connection pool
+type PoolStats struct {
+	OpenConnections int // connections in the pool
+	Idle            int // connections without calls in flight
+	InUse           int // connections with calls in flight
+	InFlight        int // calls in flight
+	Waiting         int // calls waiting for a free stream
+
+	WaitCount         int64         // calls that had to wait
+	WaitDuration      time.Duration // the total time they waited
+	MaxIdleClosed     int64         // connections closed by the idle timeout
+	MaxLifetimeClosed int64         // connections retired by the max lifetime
+}
+
+func (c *Client) Stats() PoolStats {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	if len(c.freeconn) >= DefaultConnectionPool {
-		cn.cn.Close()
-		return
+	stats := c.stats
+	stats.OpenConnections = len(c.conns)
+	stats.Waiting = len(c.waiters)
+	for _, cn := range c.conns {
+		load := cn.load()
+		if load == 0 {
+			stats.Idle++
+		} else {
+			stats.InUse++
+		}
+		stats.InFlight += load
+	}
+	return stats
+}
+
+// close the client, pending calls fail with ErrShutdown
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return ErrShutdown
+	}
+	c.closed = true
+	conns := c.conns
+	c.conns = nil
+	for _, w := range c.waiters {
+		close(w)
+	}
+	c.waiters = nil
+	if c.cleanerCh != nil {
+		close(c.cleanerCh)
+	}
+	c.mutex.Unlock()
+	for _, cn := range conns {
+		cn.fail(ErrShutdown)
+	}
+	return nil
+}
+
+// the Timeout that applies to calls without a deadline
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultTimeout
 	}
-	c.freeconn = append(c.freeconn, cn)
+	return c.Timeout
 }
 
-func (c *Client) call(req *clientRequest, args interface{}, reply interface{}) (err error) {
-	cn, err := c.getConn()
+// send the call on a pooled connection. The connection is returned so
+// the call can be abandoned, on failure the call is already complete.
+func (c *Client) send(ctx context.Context, req *Request, call *Call, expire bool) *conn {
+	deadline, _ := ctx.Deadline()
+	if !deadline.IsZero() {
+		req.Timeout = int64(time.Until(deadline) / time.Millisecond)
+		if req.Timeout <= 0 {
+			call.Error = context.DeadlineExceeded
+			call.done()
+			return nil
+		}
+	}
+	if c.credentials != nil {
+		if req.Metadata == nil {
+			req.Metadata = make(Metadata)
+		}
+		if err := c.credentials(ctx, req); err != nil {
+			call.Error = err
+			call.done()
+			return nil
+		}
+	}
+	var cn *conn
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if cn, err = c.getConn(ctx); err != nil {
+			break
+		}
+		// the connection may have been closed since we picked it
+		var ns *notSentError
+		if err = cn.send(req, call, deadline, expire); !errors.As(err, &ns) {
+			break
+		}
+		err = ns.err
+	}
 	if err != nil {
-		return
+		call.Error = err
+		call.done()
+		return nil
 	}
-	defer c.release(cn)
-	if err = cn.WriteRequest(req, args); err != nil {
-		return err
+	return cn
+}
+
+// options of a single call
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	metadata      Metadata
+	replyMetadata *Metadata
+	key           string // see WithCallKey
+}
+
+type callOptionsKey struct{}
+
+// send md with the call
+func WithMetadata(md Metadata) CallOption {
+	return func(o *callOptions) {
+		for k, v := range md {
+			if o.metadata == nil {
+				o.metadata = make(Metadata)
+			}
+			o.metadata[k] = v
+		}
 	}
-	res := &clientResponse{}
-	if err = cn.ReadResponse(res, reply); err != nil {
-		return
+}
+
+// store the metadata the server sends back in md, errors included
+func ReplyMetadata(md *Metadata) CallOption {
+	return func(o *callOptions) {
+		o.replyMetadata = md
+	}
+}
+
+// make the call, and again as the retry policy allows
+func (c *Client) call(ctx context.Context, req *Request, args interface{}, reply interface{}) error {
+	for attempt := 1; ; attempt++ {
+		sent, err := c.callOnce(ctx, req, args, reply)
+		if err == nil || !c.shouldRetry(req.Method, attempt, sent, err) {
+			return err
+		}
+		if !sleepContext(ctx, c.retry.wait(attempt, err)) {
+			return err
+		}
 	}
-	return
+}
+
+// make the call once, sent reports whether it may have reached the server
+func (c *Client) callOnce(ctx context.Context, req *Request, args interface{}, reply interface{}) (sent bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if c.breaker != nil {
+		gen, ok := c.breaker.allow(c.target)
+		if !ok {
+			return false, ErrCircuitOpen
+		}
+		defer func() { c.breaker.done(c.target, gen, err) }()
+	}
+	call := &Call{ServiceMethod: req.Method, Args: args, Reply: reply, Done: make(chan *Call, 1)}
+	cn := c.send(ctx, req, call, false)
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		if cn != nil {
+			cn.abandon(call, ctx.Err())
+		}
+		// completed by abandon, or the reply beat us to it
+		<-call.Done
+	}
+	if o, ok := ctx.Value(callOptionsKey{}).(*callOptions); ok && o.replyMetadata != nil {
+		*o.replyMetadata = call.Metadata
+	}
+	c.learnIdempotent(req.Method, call.Metadata)
+	return call.sent, call.Error
 }
 
 func (c *Client) Call(serviceMethod string, args interface{}, reply interface{}) error {
-	req := new(clientRequest)
+	return c.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// call the service method, giving up when ctx is done. The time left to
+// the deadline is sent along so the server can give up early too.
+func (c *Client) CallContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}, opts ...CallOption) error {
+	o := new(callOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	ctx = context.WithValue(ctx, callOptionsKey{}, o)
+	if _, ok := ctx.Deadline(); !ok {
+		if timeout := c.timeout(); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+	req := new(Request)
 	req.Method = serviceMethod
 	req.Operation = uint8(1)
-	err := c.call(req, args, reply)
-	if err != nil {
-		return err
+	req.Metadata = o.metadata
+	return c.invoke(ctx, req, args, reply)
+}
+
+// invoke the service method asynchronously. The call is sent on a pooled
+// connection and done receives it once it completes, no goroutine waits
+// for it meanwhile, retries and the circuit breaker included. If done is
+// nil a new channel is allocated, otherwise it must be buffered. Calls
+// give up after the Timeout. Go only blocks when it has to wait for a
+// free stream. Interceptors wait for the result they return, with any of
+// them each call runs in a goroutine of its own.
+func (c *Client) Go(serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 10) // buffered.
+	} else if cap(done) == 0 {
+		log.Panic("rpc: done channel is unbuffered")
 	}
-	return nil
+	call := &Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	if len(c.interceptors) > 0 {
+		go func() {
+			call.Error = c.CallContext(context.Background(), serviceMethod, args, reply)
+			call.done()
+		}()
+		return call
+	}
+	req := new(Request)
+	req.Method = serviceMethod
+	req.Operation = uint8(1)
+	var deadline time.Time
+	if timeout := c.timeout(); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if c.retry == nil && c.breaker == nil {
+		c.sendBy(req, call, deadline)
+		return call
+	}
+	c.goAttempt(req, call, deadline, 1)
+	return call
+}
+
+// send a Go call that is failed once deadline passes, if there is one
+func (c *Client) sendBy(req *Request, call *Call, deadline time.Time) {
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	c.send(ctx, req, call, true)
+}
+
+// make an attempt at a Go call with a retry policy or a circuit breaker.
+// The attempt reports to the breaker and schedules the next one when it
+// completes, so nothing waits for it.
+func (c *Client) goAttempt(req *Request, call *Call, deadline time.Time, attempt int) {
+	var gen uint64
+	if c.breaker != nil {
+		var ok bool
+		if gen, ok = c.breaker.allow(c.target); !ok {
+			c.goDone(req, call, deadline, attempt, false, ErrCircuitOpen)
+			return
+		}
+	}
+	try := &Call{ServiceMethod: call.ServiceMethod, Args: call.Args, Reply: call.Reply}
+	try.finish = func() {
+		if c.breaker != nil {
+			c.breaker.done(c.target, gen, try.Error)
+		}
+		call.Metadata = try.Metadata
+		c.learnIdempotent(req.Method, try.Metadata)
+		c.goDone(req, call, deadline, attempt, try.sent, try.Error)
+	}
+	c.sendBy(req, try, deadline)
+}
+
+// an attempt at a Go call is done, retry it or complete the call
+func (c *Client) goDone(req *Request, call *Call, deadline time.Time, attempt int, sent bool, err error) {
+	if err != nil && c.shouldRetry(req.Method, attempt, sent, err) {
+		wait := c.retry.wait(attempt, err)
+		if deadline.IsZero() || time.Until(deadline) > wait {
+			time.AfterFunc(wait, func() { c.goAttempt(req, call, deadline, attempt+1) })
+			return
+		}
+	}
+	call.Error = err
+	call.done()
 }
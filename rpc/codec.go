@@ -0,0 +1,317 @@
+// Date: 2026-10-17
+// the wire format, pluggable through ServerCodec and ClientCodec
+
+package rpc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"oocrpc/bson"
+	"time"
+)
+
+// operation has four values -- call:1  reply:2  error:3  goaway:4
+// goaway tells a client the server is about to close the connection,
+// it is only sent to clients that use seq
+
+// the request header
+// Seq is chosen by the client and echoed in the response, so a client can
+// keep many requests in flight on one connection. Old clients send no seq.
+type Request struct {
+	next      *Request // for the server's free list
+	Operation uint8
+	Method    string
+	Seq       uint64   `bson:"seq,omitempty"`
+	Timeout   int64    `bson:"timeout,omitempty"` // milliseconds the client will wait
+	Metadata  Metadata `bson:"metadata,omitempty"`
+}
+
+// the response header
+type Response struct {
+	next      *Response // for the server's free list
+	Operation uint8
+	Error     string
+	Code      string   `bson:"code,omitempty"` // set for a BackendError
+	Detail    string   `bson:"detail,omitempty"`
+	Seq       uint64   `bson:"seq,omitempty"`
+	Metadata  Metadata `bson:"metadata,omitempty"` // sent with errors too
+	// milliseconds to wait before calling again, for a RetryAfterError
+	RetryAfter int64 `bson:"retryafter,omitempty"`
+}
+
+// key value pairs sent along with a request or a response, for auth
+// tokens, trace ids and the like. Clients that don't know about it ignore
+// the field.
+type Metadata map[string]string
+
+// reads requests and writes responses for one connection of a Server.
+// WriteResponse is never called concurrently. A nil body passed to
+// ReadRequestBody means the body is to be discarded.
+type ServerCodec interface {
+	ReadRequestHeader(*Request) error
+	ReadRequestBody(interface{}) error
+	WriteResponse(*Response, interface{}) error
+	Close() error
+}
+
+// writes requests and reads responses for one connection of a Client.
+// WriteRequest is never called concurrently and the reads are made by a
+// single goroutine. A nil reply passed to ReadResponseBody means the body
+// is to be discarded.
+type ClientCodec interface {
+	WriteRequest(*Request, interface{}) error
+	ReadResponseHeader(*Response) error
+	ReadResponseBody(interface{}) error
+	Close() error
+}
+
+// the address of the peer if rwc is a network connection
+func remoteAddr(rwc io.ReadWriteCloser) net.Addr {
+	if cn, ok := rwc.(net.Conn); ok {
+		return cn.RemoteAddr()
+	}
+	return nil
+}
+
+// the tls state if rwc is a tls connection
+func connectionState(rwc io.ReadWriteCloser) *tls.ConnectionState {
+	if tc, ok := rwc.(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		return &cs
+	}
+	return nil
+}
+
+// the largest frames a codec reads, guarding against a corrupt or
+// malicious length prefix
+const (
+	DefaultMaxHeaderSize = 64 << 10
+	DefaultMaxBodySize   = 16 << 20
+)
+
+// the smallest bson document, an empty one
+const minFrameSize = 5
+
+// a frame that breaks the wire format, the connection it came on is
+// closed. When the header was read the caller gets a *BackendError with
+// CodeProtocolError first, which errors.Is matches to ErrProtocol.
+var ErrProtocol = errors.New("rpc: protocol error")
+
+// the code of calls whose body broke the wire format
+const CodeProtocolError = "rpc.Protocol"
+
+// how large a frame a codec reads, 0 means the default
+type FrameLimits struct {
+	MaxHeaderSize int
+	MaxBodySize   int
+}
+
+func (l FrameLimits) withDefaults() FrameLimits {
+	if l.MaxHeaderSize <= 0 {
+		l.MaxHeaderSize = DefaultMaxHeaderSize
+	}
+	if l.MaxBodySize <= 0 {
+		l.MaxBodySize = DefaultMaxBodySize
+	}
+	return l
+}
+
+// read one length prefixed bson document of at most max bytes. The
+// length is checked before anything is allocated.
+func readFrame(r io.Reader, max int) ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(prefix[:])
+	if length < minFrameSize {
+		return nil, fmt.Errorf("%w: frame of %d bytes", ErrProtocol, length)
+	}
+	if uint64(length) > uint64(max) {
+		return nil, fmt.Errorf("%w: frame of %d bytes, the limit is %d", ErrProtocol, length, max)
+	}
+	b := make([]byte, length)
+	copy(b, prefix[:])
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if b[length-1] != 0 {
+		return nil, fmt.Errorf("%w: frame not terminated", ErrProtocol)
+	}
+	return b, nil
+}
+
+// the default ServerCodec, a header document followed by a body document
+type bsonServerCodec struct {
+	rwc    io.ReadWriteCloser
+	rw     *bufio.ReadWriter
+	limits FrameLimits
+}
+
+// a ServerCodec speaking bson over conn
+func NewServerCodec(conn io.ReadWriteCloser) ServerCodec {
+	return NewServerCodecLimits(conn, FrameLimits{})
+}
+
+// a ServerCodec speaking bson over conn that reads frames up to limits
+func NewServerCodecLimits(conn io.ReadWriteCloser, limits FrameLimits) ServerCodec {
+	return &bsonServerCodec{
+		rwc:    conn,
+		rw:     bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		limits: limits.withDefaults(),
+	}
+}
+
+// read the request header
+func (c *bsonServerCodec) ReadRequestHeader(req *Request) error {
+	b, err := readFrame(c.rw.Reader, c.limits.MaxHeaderSize)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, req)
+}
+
+// read the request body
+func (c *bsonServerCodec) ReadRequestBody(body interface{}) error {
+	b, err := readFrame(c.rw.Reader, c.limits.MaxBodySize)
+	if err != nil || body == nil {
+		return err
+	}
+	return bson.Unmarshal(b, body)
+}
+
+func (c *bsonServerCodec) WriteResponse(res *Response, body interface{}) (err error) {
+
+	bys, err := bson.Marshal(res)
+	if err != nil {
+		log.Println("marshal response header error", err)
+		return
+	}
+
+	// write message header
+	rw := c.rw.Writer
+	_, err = rw.Write(bys)
+	if err != nil {
+		log.Println("write responseheader error", err)
+		return
+	}
+	// write message body
+	bys, err = bson.Marshal(body)
+	if err != nil {
+		log.Println("marshal response body error", err)
+		return
+	}
+	_, err = rw.Write(bys)
+	if err != nil {
+		log.Println("write response body error", err)
+	}
+	if err = rw.Flush(); err != nil {
+		log.Println("flush responseBody error", err)
+	}
+	return
+}
+
+func (c *bsonServerCodec) RemoteAddr() net.Addr {
+	return remoteAddr(c.rwc)
+}
+
+func (c *bsonServerCodec) ConnectionState() *tls.ConnectionState {
+	return connectionState(c.rwc)
+}
+
+func (c *bsonServerCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// the default ClientCodec
+type bsonClientCodec struct {
+	rwc    io.ReadWriteCloser
+	rw     *bufio.ReadWriter
+	limits FrameLimits
+}
+
+// a ClientCodec speaking bson over conn
+func NewClientCodec(conn io.ReadWriteCloser) ClientCodec {
+	return NewClientCodecLimits(conn, FrameLimits{})
+}
+
+// a ClientCodec speaking bson over conn that reads frames up to limits
+func NewClientCodecLimits(conn io.ReadWriteCloser, limits FrameLimits) ClientCodec {
+	return &bsonClientCodec{
+		rwc:    conn,
+		rw:     bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		limits: limits.withDefaults(),
+	}
+}
+
+func (c *bsonClientCodec) WriteRequest(req *Request, body interface{}) (err error) {
+	rw := c.rw.Writer
+	// write request header
+	bys, err := bson.Marshal(req)
+	if err != nil {
+		log.Println("marshal request header error, ", err.Error())
+		return
+	}
+	_, err = rw.Write(bys)
+	if err != nil {
+		log.Println("write request header error, ", err.Error())
+		return
+	}
+	// write request body
+	bys, err = bson.Marshal(body)
+	if err != nil {
+		log.Println("marshal request body error, ", err.Error())
+		return
+	}
+	_, err = rw.Write(bys)
+	if err != nil {
+		log.Println("write request body error, ", err.Error())
+	}
+	if err = rw.Flush(); err != nil {
+		log.Println("write request error, ", err.Error())
+	}
+	return
+}
+
+func (c *bsonClientCodec) ReadResponseHeader(res *Response) (err error) {
+	b, err := readFrame(c.rw.Reader, c.limits.MaxHeaderSize)
+	if err != nil {
+		return fmt.Errorf("rpc: client cannot read responseHeader %w", err)
+	}
+	return bson.Unmarshal(b, res)
+}
+
+// the message is always consumed, so a decode error leaves the stream usable
+func (c *bsonClientCodec) ReadResponseBody(reply interface{}) (err error) {
+	b, err := readFrame(c.rw.Reader, c.limits.MaxBodySize)
+	if err != nil {
+		return
+	}
+	if reply == nil {
+		return
+	}
+	if err = bson.Unmarshal(b, reply); err != nil {
+		return errors.New("rpc: client cannot decode reply: " + err.Error())
+	}
+	return
+}
+
+func (c *bsonClientCodec) SetWriteDeadline(t time.Time) error {
+	if cn, ok := c.rwc.(net.Conn); ok {
+		return cn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (c *bsonClientCodec) Close() error {
+	return c.rwc.Close()
+}
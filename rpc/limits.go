@@ -0,0 +1,104 @@
+// Date: 2026-10-17
+// bounding the calls a server runs at once, see SetLimits
+
+package rpc
+
+import (
+	"context"
+)
+
+// the code of calls rejected because the server is at a limit. The call
+// did not run, clients with a retry policy retry it after a backoff.
+const CodeOverloaded = "rpc.Overloaded"
+
+// how many calls a server runs at once
+type Limits struct {
+	MaxConnCalls int            // per connection, 0 means no limit
+	MaxCalls     int            // on the whole server, 0 means no limit
+	MethodCalls  map[string]int // per "Service.Method"
+	// at a limit reject calls as Overloaded, otherwise stop reading
+	// requests from the connection until the call can run
+	Reject bool
+}
+
+type limiter struct {
+	Limits
+	calls   chan struct{}            // a slot per call running, nil without a limit
+	methods map[string]chan struct{} // the same per method
+}
+
+// bound the calls the server runs at once. The new limits start out
+// empty, calls in flight count against the old ones only, so right after
+// a change up to MaxCalls more calls can run until those finish. The per
+// connection limit, and whether a connection stops reading at it, are
+// fixed when the connection is made. Reject applies to the other limits
+// from the next call on, existing connections included.
+func (server *Server) SetLimits(l Limits) {
+	lim := &limiter{Limits: l, methods: make(map[string]chan struct{})}
+	if l.MaxCalls > 0 {
+		lim.calls = make(chan struct{}, l.MaxCalls)
+	}
+	for method, n := range l.MethodCalls {
+		if n > 0 {
+			lim.methods[method] = make(chan struct{}, n)
+		}
+	}
+	server.mu.Lock()
+	server.limiter = lim
+	server.mu.Unlock()
+}
+
+func (server *Server) getLimiter() *limiter {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.limiter
+}
+
+// take the slots a call to method needs, with held the one of the
+// connection was taken before the request was read. Waits until ctx is
+// done for them, or fails at once when rejecting. release frees them
+// all, the held one too, and so does a failure.
+func (server *Server) acquire(ctx context.Context, connSlots chan struct{}, held bool, method string) (release func(), err error) {
+	lim := server.getLimiter()
+	var slots []chan struct{}
+	if connSlots != nil && !held {
+		slots = append(slots, connSlots)
+	}
+	if lim != nil {
+		if lim.calls != nil {
+			slots = append(slots, lim.calls)
+		}
+		if s := lim.methods[method]; s != nil {
+			slots = append(slots, s)
+		}
+	}
+	release = func() {
+		for _, s := range slots {
+			<-s
+		}
+		if held {
+			<-connSlots
+		}
+	}
+	for i, s := range slots {
+		if lim == nil || !lim.Reject {
+			select {
+			case s <- struct{}{}:
+				continue
+			case <-ctx.Done():
+				err = errUnavailable
+			}
+		} else {
+			select {
+			case s <- struct{}{}:
+				continue
+			default:
+				err = &BackendError{CodeOverloaded, "too many calls in flight for " + method}
+			}
+		}
+		slots = slots[:i]
+		release()
+		return nil, err
+	}
+	return release, nil
+}
@@ -0,0 +1,158 @@
+// Date: 2026-10-17
+// token bucket rate limits on the calls a server takes, see SetRateLimits
+
+package rpc
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// the code of calls over a rate limit, the call did not run
+const CodeRateLimited = "rpc.RateLimited"
+
+// a BackendError with a hint of when to call again, the client returns
+// it when the server sent one
+type RetryAfterError struct {
+	BackendError
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return &e.BackendError
+}
+
+// what calls are counted by
+type RateKey int
+
+const (
+	ByRemoteAddr RateKey = iota // the host the call comes from
+	ByPrincipal                 // the principal the Authenticator found
+	ByMethod                    // the method called
+)
+
+// a token bucket per key: Rate calls a second, and up to Burst at once
+// after a quiet spell
+type RateLimit struct {
+	Key    RateKey
+	Method string  // "Service.Method" or "Service.*" to limit, empty for every method
+	Rate   float64 // limits without a positive rate are left out
+	Burst  int     // 0 means Rate rounded up
+}
+
+type rateLimiter struct {
+	RateLimit
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limit the rate of calls, a call must be within every limit that
+// applies to it. It replaces the limits set before, with full buckets,
+// and none lifts them.
+func (server *Server) SetRateLimits(limits ...RateLimit) {
+	var rls []*rateLimiter
+	for _, l := range limits {
+		if l.Rate <= 0 {
+			continue
+		}
+		if l.Burst <= 0 {
+			l.Burst = int(math.Ceil(l.Rate))
+		}
+		rls = append(rls, &rateLimiter{RateLimit: l, buckets: make(map[string]*bucket), pruned: time.Now()})
+	}
+	server.mu.Lock()
+	server.rateLimiters = rls
+	server.mu.Unlock()
+}
+
+// check the call against the rate limits keyed by principal, or against
+// the others. Those are checked as soon as the request is read, the ones
+// by principal once the call is authenticated.
+func (server *Server) rateLimit(info *CallInfo, byPrincipal bool) error {
+	server.mu.Lock()
+	rls := server.rateLimiters
+	server.mu.Unlock()
+	method := info.Method
+	if info.Service != "" {
+		method = info.Service + "." + method
+	}
+	now := time.Now()
+	type taken struct {
+		rl  *rateLimiter
+		key string
+	}
+	var took []taken
+	for _, rl := range rls {
+		if (rl.Key == ByPrincipal) != byPrincipal || rl.Method != "" && rl.Method != method && rl.Method != info.Service+".*" {
+			continue
+		}
+		var key string
+		switch rl.Key {
+		case ByRemoteAddr:
+			if info.RemoteAddr != nil {
+				key = info.RemoteAddr.String()
+				if host, _, err := net.SplitHostPort(key); err == nil {
+					key = host
+				}
+			}
+		case ByPrincipal:
+			key = info.Principal
+		case ByMethod:
+			key = method
+		}
+		if wait := rl.take(key, now); wait > 0 {
+			// the call doesn't run, it costs the other limits nothing
+			for _, t := range took {
+				t.rl.refund(t.key)
+			}
+			return &RetryAfterError{BackendError{CodeRateLimited, "rate limit exceeded for " + method}, wait}
+		}
+		took = append(took, taken{rl, key})
+	}
+	return nil
+}
+
+// take a token from the bucket of key, or say how long until there is one
+func (rl *rateLimiter) take(key string, now time.Time) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	burst := float64(rl.Burst)
+	if now.Sub(rl.pruned) > time.Minute {
+		// full buckets are as good as new ones
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.Rate >= burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.pruned = now
+	}
+	b := rl.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rl.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rl.Rate * float64(time.Second))
+}
+
+// give back a token taken for a call that was rejected after all
+func (rl *rateLimiter) refund(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if b := rl.buckets[key]; b != nil {
+		b.tokens = math.Min(float64(rl.Burst), b.tokens+1)
+	}
+}
@@ -0,0 +1,153 @@
+// Date: 2026-10-17
+// the built-in service describing what a server has registered
+
+package rpc
+
+import (
+	"errors"
+	"oocrpc/bson"
+	"reflect"
+	"sort"
+)
+
+// the name the reflection service is registered under, call
+// "_rpc.ListServices" and "_rpc.Describe"
+const ReflectionService = "_rpc"
+
+// the reply of ListServices
+type ServiceList struct {
+	Services []string
+}
+
+// the args of Describe, an empty Service describes every service
+type DescribeArgs struct {
+	Service string
+}
+
+// the reply of Describe
+type Description struct {
+	Services []ServiceInfo
+}
+
+type ServiceInfo struct {
+	Name    string
+	Methods []MethodInfo
+}
+
+type MethodInfo struct {
+	Name  string
+	Args  *TypeSchema
+	Reply *TypeSchema
+}
+
+// how a type looks on the wire. Pointers are described by what they
+// point to, a struct seen before is only named.
+type TypeSchema struct {
+	Name   string        `bson:"name,omitempty"` // the go type, empty for unnamed types
+	Kind   string        // the reflect kind, "int64", "string", "struct", "slice"...
+	Fields []FieldSchema `bson:"fields,omitempty"` // of a struct
+	Key    *TypeSchema   `bson:"key,omitempty"`    // of a map
+	Elem   *TypeSchema   `bson:"elem,omitempty"`   // of a slice, an array or a map
+}
+
+// a struct field, Key is its name in the bson document
+type FieldSchema struct {
+	Key       string
+	Type      *TypeSchema
+	OmitEmpty bool `bson:"omitempty,omitempty"`
+	MinSize   bool `bson:"minsize,omitempty"`
+}
+
+type reflectionService struct {
+	server *Server
+}
+
+// the names of the registered services
+func (r *reflectionService) ListServices(args *struct{}, reply *ServiceList) error {
+	r.server.mu.Lock()
+	for name := range r.server.serviceMap {
+		reply.Services = append(reply.Services, name)
+	}
+	r.server.mu.Unlock()
+	sort.Strings(reply.Services)
+	return nil
+}
+
+// the methods of a service, or of every service, with their types
+func (r *reflectionService) Describe(args *DescribeArgs, reply *Description) error {
+	var services []*service
+	r.server.mu.Lock()
+	if args.Service != "" {
+		if s := r.server.serviceMap[args.Service]; s != nil {
+			services = append(services, s)
+		}
+	} else {
+		for _, s := range r.server.serviceMap {
+			services = append(services, s)
+		}
+	}
+	r.server.mu.Unlock()
+	if len(services) == 0 && args.Service != "" {
+		return errors.New("rpc: can not find service " + args.Service)
+	}
+
+	sort.Slice(services, func(i, j int) bool { return services[i].name < services[j].name })
+	for _, s := range services {
+		info := ServiceInfo{Name: s.name}
+		for name, mtype := range s.method {
+			info.Methods = append(info.Methods, MethodInfo{
+				Name:  name,
+				Args:  describeType(mtype.ArgType, map[reflect.Type]bool{}),
+				Reply: describeType(mtype.ReplyType, map[reflect.Type]bool{}),
+			})
+		}
+		sort.Slice(info.Methods, func(i, j int) bool { return info.Methods[i].Name < info.Methods[j].Name })
+		reply.Services = append(reply.Services, info)
+	}
+	return nil
+}
+
+// describe t, seen holds the structs being described to stop at cycles
+func describeType(t reflect.Type, seen map[reflect.Type]bool) *TypeSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	ts := &TypeSchema{Name: t.String(), Kind: t.Kind().String()}
+	if t.Name() == "" {
+		ts.Name = ""
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		ts.Elem = describeType(t.Elem(), seen)
+	case reflect.Map:
+		ts.Key = describeType(t.Key(), seen)
+		ts.Elem = describeType(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			break
+		}
+		seen[t] = true
+		ts.Fields = describeFields(t, seen)
+		delete(seen, t)
+	}
+	return ts
+}
+
+// the fields of a struct as the bson package encodes them, none if it
+// can't encode them
+func describeFields(t reflect.Type, seen map[reflect.Type]bool) []FieldSchema {
+	sfields, err := bson.StructFields(t)
+	if err != nil {
+		return nil
+	}
+	fields := make([]FieldSchema, 0, len(sfields))
+	for _, f := range sfields {
+		fields = append(fields, FieldSchema{
+			Key:       f.Key,
+			Type:      describeType(t.FieldByIndex(f.Index).Type, seen),
+			OmitEmpty: f.OmitEmpty,
+			MinSize:   f.MinSize,
+		})
+	}
+	return fields
+}
@@ -0,0 +1,146 @@
+// Date: 2026-10-17
+// retrying failed calls, see WithRetryPolicy
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// the metadata key a server sets on the replies of methods marked with
+// MarkIdempotent, clients with a retry policy remember those methods
+const IdempotentKey = "rpc-idempotent"
+
+// how failed calls are retried. A call that may have reached the server
+// is only sent again when its method is idempotent, either listed in
+// Idempotent or marked by the server. A retry waits at least as long as
+// the server's retry-after hint.
+type RetryPolicy struct {
+	MaxAttempts    int           // attempts in total, 0 means 3
+	InitialBackoff time.Duration // wait before the first retry, 0 means 50ms
+	MaxBackoff     time.Duration // the wait doubles up to this, 0 means 1s
+	Jitter         float64       // randomize each wait by up to this fraction
+	// whether a failed call is worth another attempt, nil means
+	// DefaultRetryable
+	Retryable  func(error) bool
+	Idempotent []string // "Service.Method" names safe to run more than once
+}
+
+// connection failures and calls a server turned away before running them,
+// because it was overloaded, rate limited or closing, are retryable. Other
+// errors are not: those returned by the server, calls that ran out of time
+// or were cancelled, calls an open circuit breaker stopped and the
+// client's own, such as a reply over its frame limit or one it can't
+// decode, which would fail the same way again.
+func DefaultRetryable(err error) bool {
+	return rejected(err) || connError(err)
+}
+
+// the connection could not be made or broke under the call
+func connError(err error) bool {
+	var ns *notSentError
+	var ne net.Error
+	switch {
+	case err == nil, errors.Is(err, ErrProtocol),
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return errors.As(err, &ns) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, errQuarantined) || errors.Is(err, errIdle) || errors.As(err, &ne)
+}
+
+// retry failed calls according to p. The retries happen beneath the
+// interceptors, they see a single call.
+func WithRetryPolicy(p RetryPolicy) DialOption {
+	return func(c *Client) {
+		if p.MaxAttempts <= 0 {
+			p.MaxAttempts = 3
+		}
+		if p.InitialBackoff <= 0 {
+			p.InitialBackoff = 50 * time.Millisecond
+		}
+		if p.MaxBackoff <= 0 {
+			p.MaxBackoff = time.Second
+		}
+		if p.Retryable == nil {
+			p.Retryable = DefaultRetryable
+		}
+		c.retry = &p
+		c.idempotent = make(map[string]bool)
+		for _, method := range p.Idempotent {
+			c.idempotent[method] = true
+		}
+	}
+}
+
+// the wait after attempt n failed with err, at least the server's hint
+func (p *RetryPolicy) wait(n int, err error) time.Duration {
+	wait := p.backoff(n)
+	var ra *RetryAfterError
+	if errors.As(err, &ra) && ra.RetryAfter > wait {
+		wait = ra.RetryAfter
+	}
+	return wait
+}
+
+// the wait before retry n, counting from 1
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < n && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// whether a call that failed with err on the given attempt goes again
+func (c *Client) shouldRetry(method string, attempt int, sent bool, err error) bool {
+	if c.retry == nil || attempt >= c.retry.MaxAttempts || !c.retry.Retryable(err) {
+		return false
+	}
+	return !sent || rejected(err) || c.isIdempotent(method)
+}
+
+// whether the server turned the call away before running it
+func rejected(err error) bool {
+	var be *BackendError
+	return errors.As(err, &be) && (be.Code == CodeOverloaded || be.Code == CodeRateLimited || be.Code == CodeUnavailable)
+}
+
+func (c *Client) isIdempotent(method string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.idempotent[method]
+}
+
+// remember the methods the server marked idempotent
+func (c *Client) learnIdempotent(method string, md Metadata) {
+	if c.retry == nil || md[IdempotentKey] == "" {
+		return
+	}
+	c.mutex.Lock()
+	c.idempotent[method] = true
+	c.mutex.Unlock()
+}
+
+// sleep before the next attempt, false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
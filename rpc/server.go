@@ -5,31 +5,33 @@
 package rpc
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 	// "runtime"
 	"unicode/utf8"
-    "oocrpc/bson"
 )
 
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 var invalidRequest = struct{}{}
-var nilRequestBody = &struct{}{}
-
 
 type methodType struct {
-	method    reflect.Method
-	ArgType   reflect.Type
-	ReplyType reflect.Type
+	method      reflect.Method
+	ArgType     reflect.Type
+	ReplyType   reflect.Type
+	withContext bool // func(ctx context.Context, args, reply *T) error
 }
 
 type service struct {
@@ -41,131 +43,99 @@ type service struct {
 
 // rpc server
 type Server struct {
-	mu         sync.Mutex
-	serviceMap map[string]*service
-	allMethod  map[string]*methodType // for python client
-    methodServiceMap map[string]*service // for python client
-	listener   *net.TCPListener
-	reqLock    sync.Mutex
-	freeReq    *serverRequest
-	respLock   sync.Mutex
-	freeResp   *serverResponse
+	mu               sync.Mutex
+	serviceMap       map[string]*service
+	allMethod        map[string]*methodType // for python client
+	methodServiceMap map[string]*service    // for python client
+	listeners        map[net.Listener]struct{}
+	reqLock          sync.Mutex
+	freeReq          *Request
+	respLock         sync.Mutex
+	freeResp         *Response
+	ctx              context.Context // cancelled by Close
+	cancel           context.CancelFunc
+	stateLock        sync.Mutex // protects inShutdown, listeners and conns
+	inShutdown       bool
+	conns            map[*connState]struct{}
+	// errors and recovered panics are reported here, nil means the
+	// standard log package
+	ErrorLog Logger
+	// when set Serve and ListenAndServe speak TLS, set ClientAuth and
+	// ClientCAs to verify client certificates
+	TLSConfig *tls.Config
+	// when set every call must pass it before it runs
+	Authenticator Authenticator
+	// the largest request header and body ServeConn reads, 0 means
+	// DefaultMaxHeaderSize and DefaultMaxBodySize
+	MaxHeaderSize int
+	MaxBodySize   int
+	interceptors  []ServerInterceptor // see Use, protected by mu
+	idempotent    map[string]bool     // see MarkIdempotent, protected by mu
+	acl           ACL                 // see SetACL, protected by mu
+	limiter       *limiter            // see SetLimits, protected by mu
+	rateLimiters  []*rateLimiter      // see SetRateLimits, protected by mu
 }
 
-// operation has three values -- call:1  reply:2  error:3
-
-// request
-type serverRequest struct {
-	next      *serverRequest // unexported
-	Operation uint8
-	Method    string
+// a *log.Logger is a Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
 }
 
-// response
-type serverResponse struct {
-	next      *serverResponse // unexported
-	Operation uint8
-	Error     string
+func (server *Server) logln(v ...interface{}) {
+	msg := fmt.Sprintln(v...)
+	if server.ErrorLog != nil {
+		server.ErrorLog.Printf("%s", msg)
+	} else {
+		log.Print(msg)
+	}
 }
 
-// decode request and encode response
-type ServerCodec struct {
-	cn net.Conn
-	rw *bufio.ReadWriter
-}
+// error codes sent in the response header. Codes starting with "rpc."
+// are the server's own, methods should not return them.
+const (
+	CodeInternalError = "rpc.Internal"    // the method panicked
+	CodeUnavailable   = "rpc.Unavailable" // the server is closing, the call did not run
+)
 
-// read the request header
-func (c *ServerCodec) ReadRequestHeader(req *serverRequest) (err error) {
-	msgheader := make([]byte, 4)
-	n, err := io.ReadFull(c.rw.Reader, msgheader)
-	if err != nil {
-		return
-	}
-	if n != 4 {
-		return io.ErrUnexpectedEOF
-	}
-	length := binary.LittleEndian.Uint32(msgheader)
-	b := make([]byte, length)
-	binary.LittleEndian.PutUint32(b, length)
-	n, err = io.ReadFull(c.rw.Reader, b[4:])
-	if err != nil {
-		if err == io.EOF {
-			return io.ErrUnexpectedEOF
-		}
-		return err
-	}
-	if n != int(length-4) {
-		return io.ErrUnexpectedEOF
-	}
-	if err = bson.Unmarshal(b, req); err != nil {
-		return
-	}
-	return
+// an error with a code callers can branch on. Methods may return it as
+// a value or a pointer, the code and detail travel in the response header
+// and the client returns them as a *BackendError.
+type BackendError struct {
+	Code   string
+	Detail string
 }
 
-// read the request body
-func (c *ServerCodec) ReadRequestBody(body interface{}) (err error) {
-	msgbody := make([]byte, 4)
-	n, err := io.ReadFull(c.rw.Reader, msgbody)
-	if err != nil {
-		return
-	}
-	if n != 4 {
-		return io.ErrUnexpectedEOF
-	}
-	length := binary.LittleEndian.Uint32(msgbody)
-	b := make([]byte, length)
-	binary.LittleEndian.PutUint32(b, length)
-	n, err = io.ReadFull(c.rw.Reader, b[4:])
-	if err != nil {
-		if err == io.EOF {
-			return io.ErrUnexpectedEOF
-		}
-		return
-	}
-    if err = bson.Unmarshal(b,body); err != nil {
-		return
-	}
-	return
+func (e BackendError) Error() string {
+	return e.Code + ": " + e.Detail
 }
 
-func (c *ServerCodec) WriteResponse(res *serverResponse, body interface{}) (err error) {
+// a CodeProtocolError is an ErrProtocol and a CodeUnavailable is an
+// ErrServerClosed
+func (e BackendError) Is(target error) bool {
+	return target == ErrProtocol && e.Code == CodeProtocolError ||
+		target == ErrServerClosed && e.Code == CodeUnavailable
+}
 
-	bys, err := bson.Marshal(res)
-	if err != nil {
-		log.Println("marshal response header error", err)
-		return
-	}
+// calls turned away because the server is closing
+var errUnavailable = &BackendError{CodeUnavailable, "server closed"}
 
-	// write message header
-	rw := c.rw.Writer
-	_, err = rw.Write(bys)
-	if err != nil {
-		log.Println("write responseheader error", err)
-		return
-	}
-	// write message body
-    bys, err = bson.Marshal(body)
-	if err != nil {
-		log.Println("marshal response body error", err)
-		return
-	}
-	_, err = rw.Write(bys)
-	if err != nil {
-		log.Println("write response body error", err)
+// find a BackendError in err's chain
+func asBackendError(err error) (*BackendError, bool) {
+	var be *BackendError
+	if errors.As(err, &be) && be != nil {
+		return be, true
 	}
-	if err = rw.Flush(); err != nil {
-		log.Println("flush responseBody error", err)
+	var bv BackendError
+	if errors.As(err, &bv) {
+		return &bv, true
 	}
-	return
+	return nil, false
 }
 
-// todo
-func (c *ServerCodec) Close() error {
-	return c.cn.Close()
-}
+// Serve returns ErrServerClosed after Shutdown or Close
+var ErrServerClosed = errors.New("rpc: server closed")
 
-// Is this an exported - upper case 
+// Is this an exported - upper case
 func isExported(name string) bool {
 	rune, _ := utf8.DecodeRuneInString(name)
 	return unicode.IsUpper(rune)
@@ -182,16 +152,17 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 
 // Register a service
 func (server *Server) Register(rcvr interface{}) error {
-	return server.register(rcvr, "", false)
+	return server.register(rcvr, "", false, false)
 }
 
 // Register a sevice with a name
 func (server *Server) RegisterName(name string, rcvr interface{}) error {
-	return server.register(rcvr, name, true)
+	return server.register(rcvr, name, true, false)
 }
 
-// the real register
-func (server *Server) register(rcvr interface{}, name string, useName bool) error {
+// the real register, builtin services are left out of allMethod so they
+// can't shadow the methods the python client calls by name
+func (server *Server) register(rcvr interface{}, name string, useName bool, builtin bool) error {
 	server.mu.Lock()
 	defer server.mu.Unlock()
 	if server.serviceMap == nil {
@@ -205,11 +176,13 @@ func (server *Server) register(rcvr interface{}, name string, useName bool) erro
 		sname = name
 	}
 	if sname == "" {
-		log.Fatal("rpc: no service name for type", s.typ.String())
+		s := "rpc: no service name for type " + s.typ.String()
+		server.logln(s)
+		return errors.New(s)
 	}
 	if !isExported(sname) && !useName {
 		s := "rpc Register: type " + sname + " is not exported"
-		log.Print(s)
+		server.logln(s)
 		return errors.New(s)
 	}
 	if _, present := server.serviceMap[sname]; present {
@@ -228,174 +201,484 @@ func (server *Server) register(rcvr interface{}, name string, useName bool) erro
 			continue
 		}
 
-		//Method needs three ins
-		if mtype.NumIn() != 3 {
-			log.Println("method needs three ins")
+		//Method needs three ins, or four when it takes a context first
+		withContext := mtype.NumIn() == 4 && mtype.In(1) == typeOfContext
+		if mtype.NumIn() != 3 && !withContext {
+			server.logln("method", mname, "needs three ins")
 			continue
 		}
+		in := 1
+		if withContext {
+			in = 2
+		}
 
 		// Method has one out:error
 		if mtype.NumOut() != 1 {
-			log.Println("method", mname, "has wrong number of outs:", mtype.NumOut())
+			server.logln("method", mname, "has wrong number of outs:", mtype.NumOut())
 			continue
 		}
 
 		// first arg need not be a pointer
-		argType := mtype.In(1)
+		argType := mtype.In(in)
 		if !isExportedOrBuiltinType(argType) {
-			log.Println(mname, "argument type not exported or local", argType)
+			server.logln(mname, "argument type not exported or local", argType)
 			continue
 		}
 
-		replyType := mtype.In(2)
+		replyType := mtype.In(in + 1)
 		if replyType.Kind() != reflect.Ptr {
-			log.Println("method", mname, " reply type not a pointer:", replyType)
+			server.logln("method", mname, " reply type not a pointer:", replyType)
 			continue
 		}
 
 		if !isExportedOrBuiltinType(replyType) {
-			log.Println("method ", mname, "reply type not exported or local", replyType)
+			server.logln("method ", mname, "reply type not exported or local", replyType)
 			continue
 		}
 
 		// error type
 		if returnType := mtype.Out(0); returnType != typeOfError {
-			log.Println("method", mname, " returns", returnType.String(), "not error")
+			server.logln("method", mname, " returns", returnType.String(), "not error")
 			continue
 		}
 
-		s.method[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType}
+		mt := &methodType{method: method, ArgType: argType, ReplyType: replyType, withContext: withContext}
+		s.method[mname] = mt
+		if builtin {
+			continue
+		}
 
 		// register the method in server's allMethod, for python client
 		if _, ok := server.allMethod[mname]; ok {
-			log.Println("method", mname, "  already exisit")
+			server.logln("method", mname, "  already exisit")
 			return errors.New("method " + mname + "  already exisit")
 		}
-		server.allMethod[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType}
-        server.methodServiceMap[mname] = s
+		server.allMethod[mname] = mt
+		server.methodServiceMap[mname] = s
 	}
 
 	if len(s.method) == 0 {
 		ss := "rpc Register: type " + sname + " has no exported methods of suitable type"
-		log.Println(ss)
+		server.logln(ss)
 		return errors.New(ss)
 	}
 	server.serviceMap[s.name] = s
 	return nil
 }
 
-func NewServer(host string, port uint) *Server {
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", host, port))
-	if err != nil {
-		log.Fatal("rpc error:", err.Error())
-	}
-	listener, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		log.Fatal("rpc error:", err.Error())
-	}
-	return &Server{
-		serviceMap: make(map[string]*service),
-		allMethod:  make(map[string]*methodType),
-        methodServiceMap: make(map[string]*service),
-		listener:   listener,
-	}
+// a server with only the reflection service registered, hand it
+// listeners with Serve
+func NewServer() *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &Server{
+		serviceMap:       make(map[string]*service),
+		allMethod:        make(map[string]*methodType),
+		methodServiceMap: make(map[string]*service),
+		listeners:        make(map[net.Listener]struct{}),
+		ctx:              ctx,
+		cancel:           cancel,
+		conns:            make(map[*connState]struct{}),
+	}
+	server.register(&reflectionService{server}, ReflectionService, true, true)
+	return server
 }
 
 // request and response pool
 
-func (server *Server) getRequest() *serverRequest {
+func (server *Server) getRequest() *Request {
 	server.reqLock.Lock()
 	req := server.freeReq
 	if req == nil {
-		req = new(serverRequest)
+		req = new(Request)
 	} else {
 		server.freeReq = req.next
-		*req = serverRequest{}
+		*req = Request{}
 	}
 	server.reqLock.Unlock()
 	return req
 }
 
-func (server *Server) freeRequest(req *serverRequest) {
+func (server *Server) freeRequest(req *Request) {
 	server.reqLock.Lock()
 	req.next = server.freeReq
 	server.freeReq = req
 	server.reqLock.Unlock()
 }
 
-func (server *Server) getResponse() *serverResponse {
+func (server *Server) getResponse() *Response {
 	server.respLock.Lock()
 	resp := server.freeResp
 	if resp == nil {
-		resp = new(serverResponse)
+		resp = new(Response)
 	} else {
 		server.freeResp = resp.next
-		*resp = serverResponse{}
+		*resp = Response{}
 	}
 	server.respLock.Unlock()
 	return resp
 }
 
-func (server *Server) freeResponse(resp *serverResponse) {
+func (server *Server) freeResponse(resp *Response) {
 	server.respLock.Lock()
 	resp.next = server.freeResp
 	server.freeResp = resp
 	server.respLock.Unlock()
 }
 
-// serv 
-func (server *Server) Serv() {
+// listen on the tcp address and serve, see Serve
+func (server *Server) ListenAndServe(addr string) error {
+	if server.shuttingDown() {
+		return ErrServerClosed
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(l)
+}
 
+// accept connections on l and serve each of them in a goroutine,
+// blocks until the server is shut down or l fails. l is closed on return.
+// With a TLSConfig the connections are wrapped in TLS.
+func (server *Server) Serve(l net.Listener) error {
+	if server.TLSConfig != nil {
+		l = tls.NewListener(l, server.TLSConfig)
+	}
+	server.stateLock.Lock()
+	if server.inShutdown {
+		server.stateLock.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	server.listeners[l] = struct{}{}
+	server.stateLock.Unlock()
+	defer func() {
+		server.stateLock.Lock()
+		delete(server.listeners, l)
+		server.stateLock.Unlock()
+		l.Close()
+	}()
+
+	var delay time.Duration
 	for {
-		c, err := server.listener.Accept()
+		c, err := l.Accept()
 		if err != nil {
-			log.Print("rpc:", err.Error())
+			if server.shuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// probably out of file descriptors, back off a little
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			server.logln("rpc:", err.Error())
+			time.Sleep(delay)
 			continue
 		}
+		delay = 0
 		go server.ServeConn(c)
 	}
+}
+
+// the state of a served connection
+type connState struct {
+	codec       ServerCodec
+	sending     sync.Mutex
+	inflight    int  // calls being run
+	closing     bool // close once inflight drops to zero
+	multiplexed bool // the client sent a seq, so it knows goaway
+}
 
+func (server *Server) shuttingDown() bool {
+	server.stateLock.Lock()
+	defer server.stateLock.Unlock()
+	return server.inShutdown
 }
 
+// stop accepting, wait for running calls to finish and close every
+// connection. If ctx expires first its error is returned and the
+// remaining connections are left to Close.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.stateLock.Lock()
+	server.inShutdown = true
+	err := server.closeListeners()
+	var idle []*connState
+	for st := range server.conns {
+		if !st.closing && st.inflight == 0 {
+			idle = append(idle, st)
+		}
+		st.closing = true
+	}
+	server.stateLock.Unlock()
+
+	for _, st := range idle {
+		server.goaway(st)
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		server.stateLock.Lock()
+		n := len(server.conns)
+		server.stateLock.Unlock()
+		if n == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop accepting and close every connection right away, the contexts of
+// running calls are cancelled
+func (server *Server) Close() error {
+	server.stateLock.Lock()
+	server.inShutdown = true
+	err := server.closeListeners()
+	conns := make([]*connState, 0, len(server.conns))
+	for st := range server.conns {
+		conns = append(conns, st)
+	}
+	server.stateLock.Unlock()
+
+	server.cancel()
+	for _, st := range conns {
+		st.codec.Close()
+	}
+	return err
+}
+
+// stateLock must be held
+func (server *Server) closeListeners() error {
+	var err error
+	for l := range server.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// tell the client we are going away and close the connection
+func (server *Server) goaway(st *connState) {
+	st.sending.Lock()
+	if st.multiplexed {
+		resp := server.getResponse()
+		resp.Operation = uint8(4)
+		if err := st.codec.WriteResponse(resp, invalidRequest); err != nil {
+			server.logln("rpc: writing goaway:", err)
+		}
+		server.freeResponse(resp)
+	}
+	st.sending.Unlock()
+	st.codec.Close()
+}
+
+// count a call in, false if the connection is closing
+func (server *Server) startCall(st *connState, req *Request) bool {
+	server.stateLock.Lock()
+	defer server.stateLock.Unlock()
+	if req.Seq != 0 {
+		st.multiplexed = true
+	}
+	if st.closing {
+		return false
+	}
+	st.inflight++
+	return true
+}
+
+func (server *Server) finishCall(st *connState) {
+	server.stateLock.Lock()
+	st.inflight--
+	drained := st.closing && st.inflight == 0
+	server.stateLock.Unlock()
+	if drained {
+		server.goaway(st)
+	}
+}
+
+// how long a client has to finish the tls handshake
+const handshakeTimeout = 10 * time.Second
+
 func (server *Server) ServeConn(conn net.Conn) {
-	src := &ServerCodec{
-		cn: conn,
-		rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+	codec := NewServerCodecLimits(conn, FrameLimits{server.MaxHeaderSize, server.MaxBodySize})
+	st := server.trackConn(codec)
+	if st == nil {
+		return
+	}
+	defer server.untrackConn(st)
+	if tc, ok := conn.(*tls.Conn); ok {
+		// handshake up front so calls see the peer's certificate. The
+		// connection is tracked already, Close and Shutdown reach it.
+		tc.SetDeadline(time.Now().Add(handshakeTimeout))
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+		if err != nil {
+			server.logln("rpc: tls handshake:", err)
+			codec.Close()
+			return
+		}
 	}
-	server.ServeCodec(src)
+	server.serve(st)
+}
+
+func (server *Server) ServeCodec(codec ServerCodec) {
+	st := server.trackConn(codec)
+	if st == nil {
+		return
+	}
+	defer server.untrackConn(st)
+	server.serve(st)
+}
+
+// count the connection in, nil and closed if the server is shutting down
+func (server *Server) trackConn(codec ServerCodec) *connState {
+	st := &connState{codec: codec}
+	server.stateLock.Lock()
+	defer server.stateLock.Unlock()
+	if server.inShutdown {
+		codec.Close()
+		return nil
+	}
+	server.conns[st] = struct{}{}
+	return st
 }
 
-func (server *Server) ServeCodec(codec *ServerCodec) {
-	sending := new(sync.Mutex)
+func (server *Server) untrackConn(st *connState) {
+	server.stateLock.Lock()
+	delete(server.conns, st)
+	server.stateLock.Unlock()
+}
+
+// read requests off the connection and run them until it goes away
+func (server *Server) serve(st *connState) {
+	codec := st.codec
+	sending := &st.sending
+	// calls made on this connection are cancelled once it goes away and
+	// the loop sees it, which for calls without a seq is only after they return
+	ctx, cancel := context.WithCancel(server.ctx)
+	defer cancel()
+	var connSlots chan struct{}
+	backpressure := true
+	if lim := server.getLimiter(); lim != nil {
+		if lim.MaxConnCalls > 0 {
+			connSlots = make(chan struct{}, lim.MaxConnCalls)
+		}
+		backpressure = !lim.Reject
+	}
 	for {
+		held := false
+		if connSlots != nil && backpressure {
+			// stop reading until a call on this connection is done
+			select {
+			case connSlots <- struct{}{}:
+				held = true
+			case <-ctx.Done():
+			}
+			if !held {
+				break
+			}
+		}
 		service, mtype, req, argv, replyv, keepReading, err := server.readRequest(codec)
+		if err != nil && held {
+			<-connSlots
+		}
 		if err != nil {
 			if err != io.EOF {
-				log.Println(err)
+				server.logln(err)
 			}
 			if !keepReading {
+				if req != nil && errors.Is(err, ErrProtocol) {
+					// the header was read, tell the caller before closing
+					detail := strings.TrimPrefix(err.Error(), ErrProtocol.Error()+": ")
+					server.sendResponse(sending, req, invalidRequest, codec, &BackendError{CodeProtocolError, detail}, nil)
+				}
 				break
 			}
 			// we just got the req
 			if req != nil {
-				server.sendResponse(sending, req, invalidRequest, codec, err.Error())
+				// callers that can't authenticate don't learn which
+				// methods exist, and can't guess tokens faster than the
+				// rate limits allow
+				info := newCallInfo(req, codec)
+				info.Method = req.Method
+				if dot := strings.LastIndex(req.Method, "."); dot >= 0 {
+					info.Service, info.Method = req.Method[:dot], req.Method[dot+1:]
+				}
+				if lerr := server.rateLimit(info, false); lerr != nil {
+					err = lerr
+				} else if aerr := server.authenticate(context.WithValue(ctx, callInfoKey{}, info), req); aerr != nil {
+					err = aerr
+				}
+				server.sendResponse(sending, req, invalidRequest, codec, err, nil)
 				server.freeRequest(req)
 			}
 			continue
 		}
-		go service.call(server, sending, mtype, req, argv, replyv, codec)
+		if !server.startCall(st, req) {
+			if held {
+				<-connSlots
+			}
+			server.sendResponse(sending, req, invalidRequest, codec, errUnavailable, nil)
+			server.freeRequest(req)
+			continue
+		}
+		// limits by address and method are checked before the call takes
+		// a slot or is authenticated, so floods of bad calls are throttled
+		info := &CallInfo{Service: service.name, Method: mtype.method.Name, RemoteAddr: codecRemoteAddr(codec)}
+		if err = server.rateLimit(info, false); err != nil {
+			if held {
+				<-connSlots
+			}
+			server.sendResponse(sending, req, invalidRequest, codec, err, nil)
+			server.freeRequest(req)
+			server.finishCall(st)
+			continue
+		}
+		release, err := server.acquire(ctx, connSlots, held, service.name+"."+mtype.method.Name)
+		if err != nil {
+			server.sendResponse(sending, req, invalidRequest, codec, err, nil)
+			server.freeRequest(req)
+			server.finishCall(st)
+			continue
+		}
+		// requests without a seq come from clients that match responses
+		// by order, so they are served one at a time. Nothing reads the
+		// connection meanwhile, so their ctx is not cancelled if the
+		// client hangs up, only by the server closing or the timeout the call was sent with.
+		if req.Seq == 0 {
+			service.call(ctx, server, sending, mtype, req, argv, replyv, codec)
+			release()
+			server.finishCall(st)
+			continue
+		}
+		go func() {
+			service.call(ctx, server, sending, mtype, req, argv, replyv, codec)
+			release()
+			server.finishCall(st)
+		}()
 	}
 	codec.Close()
 }
 
-func (server *Server) readRequest(codec *ServerCodec) (service *service, mtype *methodType, req *serverRequest, argv reflect.Value, replyv reflect.Value, keepReading bool, err error) {
+func (server *Server) readRequest(codec ServerCodec) (service *service, mtype *methodType, req *Request, argv reflect.Value, replyv reflect.Value, keepReading bool, err error) {
 	service, mtype, req, keepReading, err = server.readRequestHeader(codec)
 	if err != nil {
 		if !keepReading {
 			return
 		}
 		// just discard body
-		codec.ReadRequestBody(nilRequestBody)
+		if berr := codec.ReadRequestBody(nil); brokenStream(berr) {
+			keepReading, err = false, berr
+		}
 		return
 	}
 
@@ -407,8 +690,9 @@ func (server *Server) readRequest(codec *ServerCodec) (service *service, mtype *
 		argIsValue = true
 	}
 
-	// argv guaranteed to be a pointer 
+	// argv guaranteed to be a pointer
 	if err = codec.ReadRequestBody(argv.Interface()); err != nil {
+		keepReading = !brokenStream(err)
 		return
 	}
 	if argIsValue {
@@ -418,7 +702,13 @@ func (server *Server) readRequest(codec *ServerCodec) (service *service, mtype *
 	return
 }
 
-func (server *Server) readRequestHeader(codec *ServerCodec) (service *service, mtype *methodType, req *serverRequest, keepReading bool, err error) {
+// whether a body could not be read at all, leaving the next request
+// nowhere to start from
+func brokenStream(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, ErrProtocol)
+}
+
+func (server *Server) readRequestHeader(codec ServerCodec) (service *service, mtype *methodType, req *Request, keepReading bool, err error) {
 	req = server.getRequest()
 	err = codec.ReadRequestHeader(req)
 	if err != nil {
@@ -426,26 +716,31 @@ func (server *Server) readRequestHeader(codec *ServerCodec) (service *service, m
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			return
 		}
-		err = errors.New("rpc: server cannot decode the requestheader: " + err.Error())
+		if errors.Is(err, net.ErrClosed) {
+			// closed by goaway, Shutdown or Close, nothing went wrong
+			err = io.EOF
+			return
+		}
+		err = fmt.Errorf("rpc: server cannot decode the requestheader: %w", err)
 		return
 	}
 
 	keepReading = true
 	serviceMethod := strings.Split(req.Method, ".")
-	// just have the method  
+	// just have the method
 	if len(serviceMethod) == 1 {
 		server.mu.Lock()
 		mtype = server.allMethod[serviceMethod[0]]
-        service = server.methodServiceMap[serviceMethod[0]]
+		service = server.methodServiceMap[serviceMethod[0]]
 		server.mu.Unlock()
 		if mtype == nil {
 			err = errors.New("rpc: can not find method " + req.Method)
-            return
+			return
+		}
+		if service == nil {
+			err = errors.New("rpc: can not find service " + req.Method)
+			return
 		}
-        if service == nil {
-            err = errors.New("rpc: can not find service " + req.Method)
-            return 
-        }
 	}
 	// need to check service and method all
 	if len(serviceMethod) == 2 {
@@ -464,10 +759,21 @@ func (server *Server) readRequestHeader(codec *ServerCodec) (service *service, m
 	return
 }
 
-func (server *Server) sendResponse(sending *sync.Mutex, req *serverRequest, reply interface{}, codec *ServerCodec, errmsg string) {
+func (server *Server) sendResponse(sending *sync.Mutex, req *Request, reply interface{}, codec ServerCodec, err error, md Metadata) {
 	resp := server.getResponse()
-	if errmsg != "" {
-		resp.Error = errmsg
+	resp.Seq = req.Seq
+	resp.Metadata = md
+	if err != nil {
+		resp.Error = err.Error()
+		if be, ok := asBackendError(err); ok {
+			resp.Code = be.Code
+			resp.Detail = be.Detail
+		}
+		var ra *RetryAfterError
+		if errors.As(err, &ra) && ra.RetryAfter > 0 {
+			// in milliseconds, rounded up
+			resp.RetryAfter = int64((ra.RetryAfter + time.Millisecond - 1) / time.Millisecond)
+		}
 		reply = invalidRequest
 		resp.Operation = uint8(3)
 	} else {
@@ -475,26 +781,206 @@ func (server *Server) sendResponse(sending *sync.Mutex, req *serverRequest, repl
 	}
 
 	sending.Lock()
-    err := codec.WriteResponse(resp, reply)
+	err = codec.WriteResponse(resp, reply)
 	if err != nil {
-		log.Println("rpc: writing response:", err)
+		server.logln("rpc: writing response:", err)
 	}
 	sending.Unlock()
 	server.freeResponse(resp)
 }
 
+// information about the call being served
+type CallInfo struct {
+	Service    string
+	Method     string
+	Seq        uint64
+	RemoteAddr net.Addr
+	Metadata   Metadata // sent by the client, never nil
+	// the state of the connection, nil unless it speaks TLS
+	TLS *tls.ConnectionState
+	// the leaf of the client certificate's first verified chain,
+	// nil unless the client was verified
+	PeerCertificate *x509.Certificate
+	// who the server's Authenticator says made the call
+	Principal string
+}
+
+type callInfoKey struct{}
+
+// metadata a method sends back with its response
+type replyMetadata struct {
+	mu sync.Mutex
+	md Metadata
+}
+
+type replyMetadataKey struct{}
+
+// set metadata to send back with the response of the call ctx was
+// passed to, it is sent with errors too. False outside of a call.
+func SetMetadata(ctx context.Context, key, value string) bool {
+	rm, ok := ctx.Value(replyMetadataKey{}).(*replyMetadata)
+	if !ok {
+		return false
+	}
+	rm.mu.Lock()
+	if rm.md == nil {
+		rm.md = make(Metadata)
+	}
+	rm.md[key] = value
+	rm.mu.Unlock()
+	return true
+}
+
+func getReplyMetadata(ctx context.Context) Metadata {
+	rm, ok := ctx.Value(replyMetadataKey{}).(*replyMetadata)
+	if !ok {
+		return nil
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.md
+}
+
+// return the CallInfo of the call ctx was passed to
+func CallInfoFromContext(ctx context.Context) (*CallInfo, bool) {
+	info, ok := ctx.Value(callInfoKey{}).(*CallInfo)
+	return info, ok
+}
+
+// the address of the peer if the codec knows it
+func codecRemoteAddr(codec ServerCodec) net.Addr {
+	if ra, ok := codec.(interface{ RemoteAddr() net.Addr }); ok {
+		return ra.RemoteAddr()
+	}
+	return nil
+}
+
+// the context of a call, it carries the CallInfo and the deadline the
+// client sent along
+func (s *service) callContext(ctx context.Context, mtype *methodType, req *Request, codec ServerCodec) (context.Context, context.CancelFunc) {
+	info := newCallInfo(req, codec)
+	info.Service, info.Method = s.name, mtype.method.Name
+	ctx = context.WithValue(ctx, callInfoKey{}, info)
+	ctx = context.WithValue(ctx, replyMetadataKey{}, new(replyMetadata))
+	if req.Timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Millisecond)
+	}
+	return context.WithCancel(ctx)
+}
+
+// what is known of a call before its method is looked up
+func newCallInfo(req *Request, codec ServerCodec) *CallInfo {
+	info := &CallInfo{
+		Seq:      req.Seq,
+		Metadata: req.Metadata,
+	}
+	if info.Metadata == nil {
+		info.Metadata = Metadata{}
+	}
+	info.RemoteAddr = codecRemoteAddr(codec)
+	if cs, ok := codec.(interface{ ConnectionState() *tls.ConnectionState }); ok {
+		info.TLS = cs.ConnectionState()
+		if info.TLS != nil && len(info.TLS.VerifiedChains) > 0 {
+			info.PeerCertificate = info.TLS.VerifiedChains[0][0]
+		}
+	}
+	return info
+}
+
 // run the service.method
-func (s *service) call(server *Server, sending *sync.Mutex, mtype *methodType, req *serverRequest, argv, replyv reflect.Value, codec *ServerCodec) {
-	function := mtype.method.Func
-	returnValues := function.Call([]reflect.Value{s.rcvr, argv, replyv})
-	errInter := returnValues[0].Interface()
-	errmsg := ""
-	if errInter != nil {
-		errmsg = errInter.(error).Error()
-	}
-	server.sendResponse(sending, req, replyv.Interface(), codec, errmsg)
+func (s *service) call(ctx context.Context, server *Server, sending *sync.Mutex, mtype *methodType, req *Request, argv, replyv reflect.Value, codec ServerCodec) {
+	ctx, cancel := s.callContext(ctx, mtype, req, codec)
+	if server.isIdempotent(s.name + "." + mtype.method.Name) {
+		SetMetadata(ctx, IdempotentKey, "true")
+	}
+	err := server.authenticate(ctx, req)
+	if err == nil {
+		info, _ := CallInfoFromContext(ctx)
+		if err = server.authorize(info); err == nil {
+			err = server.rateLimit(info, true)
+		}
+	}
+	if err == nil {
+		err = s.invoke(ctx, server, mtype, argv, replyv)
+	}
+	cancel()
+	server.sendResponse(sending, req, replyv.Interface(), codec, err, getReplyMetadata(ctx))
 	server.freeRequest(req)
 }
 
+// call the method, a panic is logged and turned into a CodeInternalError
+func (s *service) invoke(ctx context.Context, server *Server, mtype *methodType, argv, replyv reflect.Value) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			server.logln("rpc: panic serving", s.name+"."+mtype.method.Name+":", r, "\n"+string(debug.Stack()))
+			err = &BackendError{CodeInternalError, "panic serving " + s.name + "." + mtype.method.Name}
+		}
+	}()
+
+	handler := func(ctx context.Context, args, reply interface{}) error {
+		var returnValues []reflect.Value
+		function := mtype.method.Func
+		if mtype.withContext {
+			returnValues = function.Call([]reflect.Value{s.rcvr, reflect.ValueOf(ctx), reflect.ValueOf(args), reflect.ValueOf(reply)})
+		} else {
+			returnValues = function.Call([]reflect.Value{s.rcvr, reflect.ValueOf(args), reflect.ValueOf(reply)})
+		}
+		if errInter := returnValues[0].Interface(); errInter != nil {
+			return errInter.(error)
+		}
+		return nil
+	}
+
+	server.mu.Lock()
+	interceptors := server.interceptors
+	server.mu.Unlock()
+	info, _ := CallInfoFromContext(ctx)
+	return chain(interceptors, info, handler)(ctx, argv.Interface(), replyv.Interface())
+}
+
+// tell clients with a retry policy that the "Service.Method"s are safe
+// to call more than once, they may then retry calls that failed midway
+func (server *Server) MarkIdempotent(serviceMethods ...string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.idempotent == nil {
+		server.idempotent = make(map[string]bool)
+	}
+	for _, serviceMethod := range serviceMethods {
+		server.idempotent[serviceMethod] = true
+	}
+}
+
+func (server *Server) isIdempotent(serviceMethod string) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.idempotent[serviceMethod]
+}
+
+// a method call, or the rest of the interceptor chain
+type Handler func(ctx context.Context, args, reply interface{}) error
+
+// wraps every call. It sees the decoded args, the reply and the error
+// next returns, and may return without calling next at all.
+type ServerInterceptor func(ctx context.Context, info *CallInfo, args, reply interface{}, next Handler) error
+
+// add interceptors, they run in the order they were added
+func (server *Server) Use(interceptors ...ServerInterceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	// copy, calls in flight hold on to the old slice
+	server.interceptors = append(append([]ServerInterceptor(nil), server.interceptors...), interceptors...)
+}
+
+func chain(interceptors []ServerInterceptor, info *CallInfo, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, args, reply interface{}) error {
+			return interceptor(ctx, info, args, reply, next)
+		}
+	}
+	return handler
+}
+
 //////////////////////////////////////////////////////////////////////
 // some test